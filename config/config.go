@@ -0,0 +1,621 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the runtime configuration of the onboarding server. Values are
+// resolved in order: built-in defaults, JSON config file, environment, flags.
+type Config struct {
+	Server  ServerConfig  `json:"server"`
+	UCS     UCSConfig     `json:"ucs"`
+	Entra   EntraConfig   `json:"entra"`
+	Google  GoogleConfig  `json:"google"`
+	Secrets SecretsConfig `json:"secrets"`
+	Store   StoreConfig   `json:"store"`
+	Vault   VaultConfig   `json:"vault"`
+}
+
+type ServerConfig struct {
+	Port string `json:"port"`
+}
+
+type UCSConfig struct {
+	// base url of ucs, e.g. http://192.168.1.1:9580
+	BaseURL string `json:"base_url"`
+
+	// secret name of the api key ucs sends as a bearer token on the endpoints
+	// that change a tenant, such as offboarding
+	APIKeyName string `json:"api_key_name"`
+}
+
+const (
+	AuthMethodSecret      = "secret"
+	AuthMethodCertificate = "certificate"
+
+	OnFailureResume   = "resume"
+	OnFailureRollback = "rollback"
+
+	// WriteProbeConditional sends an empty PATCH with an If-Match no object
+	// matches, the write path answers 412 once the application propagated and
+	// nothing is written. WriteProbeNoop sends the empty PATCH unconditionally,
+	// it changes no property but is still a write recorded in the audit log.
+	// WriteProbeNotes rewrites the notes with a timestamp, WriteProbeNone only
+	// checks read access.
+	WriteProbeConditional = "conditional"
+	WriteProbeNoop        = "noop"
+	WriteProbeNotes       = "notes"
+	WriteProbeNone        = "none"
+
+	// national clouds of Microsoft Entra
+	CloudGlobal = "global"
+	CloudUSGov  = "usgov"
+	CloudChina  = "china"
+)
+
+type EntraConfig struct {
+	ClientID         string `json:"client_id"`          // from bootstrap app (company tenant)
+	ClientSecretName string `json:"client_secret_name"` // secret name of the bootstrap app client secret
+	RedirectURI      string `json:"redirect_uri"`       // configured in bootstrap app (company tenant)
+	AuthURI          string `json:"auth_uri"`           // empty for the common endpoint of the cloud
+	TokenURI         string `json:"token_uri"`          // empty for the common endpoint of the cloud
+
+	// national cloud of the customer tenants: global, usgov or china
+	Cloud string `json:"cloud"`
+
+	// how the bootstrap app authenticates: secret or certificate
+	AuthMethod string `json:"auth_method"`
+
+	// PEM or PFX file holding the certificate and private key of the bootstrap app
+	CertificateFile string `json:"certificate_file"`
+
+	// secret name of the certificate/private key password, empty if unencrypted
+	CertificatePasswordName string `json:"certificate_password_name"`
+
+	// comma separated onboarding steps run after consent, "all" for every step.
+	// empty only acquires the token.
+	OnboardingSteps string `json:"onboarding_steps"`
+
+	// when onboarding fails: resume keeps the created resources for the next run,
+	// rollback deletes them
+	OnFailure string `json:"on_failure"`
+
+	// saml token signing certificates
+	SigningCertificate SigningCertificateConfig `json:"signing_certificate"`
+
+	// JSON saml claims spec, see claims.example.json. empty leaves the claims
+	// of the application untouched and does not request the
+	// Policy.ReadWrite.ApplicationConfiguration permission.
+	ClaimsFile string `json:"claims_file"`
+
+	// directory of the downloaded federation metadata, one history per tenant
+	// and application. metadata stays in memory when empty.
+	MetadataDir string `json:"metadata_dir"`
+
+	// backoff of the application and synchronization job readiness waits
+	Polling PollingConfig `json:"polling"`
+
+	// enterprise application instantiated per onboarding
+	Application ApplicationConfig `json:"application"`
+
+	// secret name prefix of per-idp scim tokens, the idp unique id is appended.
+	// the token returned by ucs is used when no such secret exists.
+	ScimTokenSecretPrefix string `json:"scim_token_secret_prefix"`
+}
+
+type SigningCertificateConfig struct {
+	// certificate subject, {unique_id} is replaced, must start with CN=
+	DisplayName string `json:"display_name"`
+
+	// validity of new certificates, at most three years
+	Validity string `json:"validity"`
+
+	// rotate once the active certificate expires within this period
+	RotateBefore string `json:"rotate_before"`
+
+	// how often every onboarded tenant is checked for a due rotation, 0 to
+	// only rotate on request. enable it on one replica only
+	CheckInterval string `json:"check_interval"`
+}
+
+// ValidFor returns the parsed validity
+func (c SigningCertificateConfig) ValidFor() time.Duration {
+	d, _ := time.ParseDuration(c.Validity)
+	return d
+}
+
+// RotateWithin returns the parsed rotation window
+func (c SigningCertificateConfig) RotateWithin() time.Duration {
+	d, _ := time.ParseDuration(c.RotateBefore)
+	return d
+}
+
+// CheckEvery returns the parsed check interval
+func (c SigningCertificateConfig) CheckEvery() time.Duration {
+	d, _ := time.ParseDuration(c.CheckInterval)
+	return d
+}
+
+// Validate checks the validity, rotation window and check interval.
+func (c SigningCertificateConfig) Validate() error {
+	validity, err := time.ParseDuration(c.Validity)
+	if err != nil || validity <= 0 || validity > 3*365*24*time.Hour {
+		return fmt.Errorf("config: invalid entra.signing_certificate.validity %q, want at most 3 years", c.Validity)
+	}
+	rotateBefore, err := time.ParseDuration(c.RotateBefore)
+	if err != nil || rotateBefore < 0 || rotateBefore >= validity {
+		return fmt.Errorf("config: invalid entra.signing_certificate.rotate_before %q, want less than the validity", c.RotateBefore)
+	}
+	if d, err := time.ParseDuration(c.CheckInterval); err != nil || d < 0 {
+		return fmt.Errorf("config: invalid entra.signing_certificate.check_interval %q", c.CheckInterval)
+	}
+	return nil
+}
+
+type PollingConfig struct {
+	// delay before the second readiness check, doubled after each attempt
+	InitialInterval string `json:"initial_interval"`
+
+	// upper bound of the delay between checks
+	MaxInterval string `json:"max_interval"`
+
+	// fraction of each delay randomized, 0 to 1
+	Jitter string `json:"jitter"`
+
+	// deadline of the application readiness wait
+	ApplicationTimeout string `json:"application_timeout"`
+
+	// deadline of the synchronization job readiness wait
+	JobTimeout string `json:"job_timeout"`
+
+	// how the application readiness wait confirms write access: conditional, noop, notes or none
+	WriteProbe string `json:"write_probe"`
+}
+
+// Backoff returns the parsed initial and maximum intervals
+func (p PollingConfig) Backoff() (initial, maxInterval time.Duration) {
+	initial, _ = time.ParseDuration(p.InitialInterval)
+	maxInterval, _ = time.ParseDuration(p.MaxInterval)
+	return initial, maxInterval
+}
+
+// Timeouts returns the parsed application and synchronization job deadlines
+func (p PollingConfig) Timeouts() (application, job time.Duration) {
+	application, _ = time.ParseDuration(p.ApplicationTimeout)
+	job, _ = time.ParseDuration(p.JobTimeout)
+	return application, job
+}
+
+// JitterFraction returns the parsed jitter
+func (p PollingConfig) JitterFraction() float64 {
+	jitter, _ := strconv.ParseFloat(p.Jitter, 64)
+	return jitter
+}
+
+// Validate checks the intervals, timeouts and jitter.
+func (p PollingConfig) Validate() error {
+	var errs []error
+	for key, value := range map[string]string{
+		"initial_interval":    p.InitialInterval,
+		"max_interval":        p.MaxInterval,
+		"application_timeout": p.ApplicationTimeout,
+		"job_timeout":         p.JobTimeout,
+	} {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("config: invalid entra.polling.%s %q", key, value))
+		}
+	}
+	if jitter, err := strconv.ParseFloat(p.Jitter, 64); err != nil || jitter < 0 || jitter > 1 {
+		errs = append(errs, fmt.Errorf("config: invalid entra.polling.jitter %q, want 0 to 1", p.Jitter))
+	}
+	switch p.WriteProbe {
+	case WriteProbeConditional, WriteProbeNoop, WriteProbeNotes, WriteProbeNone:
+	default:
+		errs = append(errs, fmt.Errorf("config: unknown entra.polling.write_probe %q, want conditional, noop, notes or none", p.WriteProbe))
+	}
+	return errors.Join(errs...)
+}
+
+type ApplicationConfig struct {
+	// application template id, empty for the custom non-gallery template
+	TemplateID string `json:"template_id"`
+
+	// display name, {unique_id} is replaced by the idp unique id. without
+	// {unique_id} an existing application is only reused when it carries the
+	// idp tag, never adopted by display name. {date} is rejected, the name must
+	// stay the same between runs.
+	DisplayNamePattern string `json:"display_name_pattern"`
+
+	// notes, {unique_id} and {date} are replaced
+	Notes string `json:"notes"`
+
+	// comma separated extra tags
+	Tags string `json:"tags"`
+
+	// png/jpeg logo file
+	LogoFile string `json:"logo_file"`
+
+	// comma separated owner object ids
+	Owners string `json:"owners"`
+}
+
+// Validate rejects display name patterns that change between runs.
+func (a ApplicationConfig) Validate() error {
+	if strings.Contains(a.DisplayNamePattern, "{date}") {
+		return fmt.Errorf("config: entra.application.display_name_pattern %q must not contain {date}", a.DisplayNamePattern)
+	}
+	return nil
+}
+
+type GoogleConfig struct {
+	ClientID         string `json:"client_id"`
+	ClientSecretName string `json:"client_secret_name"`
+	RedirectURI      string `json:"redirect_uri"`
+	AuthURI          string `json:"auth_uri"`
+	TokenURI         string `json:"token_uri"`
+}
+
+const (
+	SecretProviderEnv       = "env"
+	SecretProviderFile      = "file"
+	SecretProviderEncrypted = "encrypted"
+)
+
+type SecretsConfig struct {
+	// env, file or encrypted
+	Provider string `json:"provider"`
+
+	// env variable prefix for the env provider
+	EnvPrefix string `json:"env_prefix"`
+
+	// secrets directory for the file and encrypted providers
+	Dir string `json:"dir"`
+
+	// NaCl secretbox key for the encrypted provider
+	KeyFile string `json:"key_file"`
+}
+
+const (
+	StoreBackendMemory = "memory"
+	StoreBackendBolt   = "bolt"
+	StoreBackendRedis  = "redis"
+)
+
+type StoreConfig struct {
+	// memory, bolt or redis
+	Backend string `json:"backend"`
+
+	// database file of the bolt backend
+	Path string `json:"path"`
+
+	// redis://[user@]host:port/db of the redis backend
+	RedisURL string `json:"redis_url"`
+
+	// secret name of the redis password, empty if the url carries none
+	RedisPasswordName string `json:"redis_password_name"`
+}
+
+type VaultConfig struct {
+	// directory of the token vault keys, keys stay in memory when empty and
+	// entries sealed in a persistent store can't be opened after a restart.
+	// must be shared between replicas using a shared store.
+	KeyDir string `json:"key_dir"`
+
+	// key rotation interval, e.g. 24h
+	RotateInterval string `json:"rotate_interval"`
+
+	// longest time a sealed entry is kept, e.g. 2160h for the 90 day refresh
+	// token lifetime. a retired key is dropped once this has passed.
+	Retention string `json:"retention"`
+}
+
+// RotateEvery returns the parsed rotation interval
+func (v VaultConfig) RotateEvery() time.Duration {
+	d, _ := time.ParseDuration(v.RotateInterval)
+	return d
+}
+
+// RetainFor returns the parsed retention
+func (v VaultConfig) RetainFor() time.Duration {
+	d, _ := time.ParseDuration(v.Retention)
+	return d
+}
+
+// Validate checks the rotation interval and retention.
+func (v VaultConfig) Validate() error {
+	if _, err := time.ParseDuration(v.RotateInterval); err != nil {
+		return fmt.Errorf("config: invalid vault.rotate_interval %q: %w", v.RotateInterval, err)
+	}
+	if d, err := time.ParseDuration(v.Retention); err != nil || d <= 0 {
+		return fmt.Errorf("config: invalid vault.retention %q, want a positive duration", v.Retention)
+	}
+	return nil
+}
+
+// Default returns a Config holding every non-secret default.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: "8080",
+		},
+		UCS: UCSConfig{
+			APIKeyName: "ucs_api_key",
+		},
+		Entra: EntraConfig{
+			ClientSecretName:      "entra_client_secret",
+			AuthMethod:            AuthMethodSecret,
+			OnFailure:             OnFailureResume,
+			RedirectURI:           "http://localhost:8080/auth/callback",
+			Cloud:                 CloudGlobal,
+			ScimTokenSecretPrefix: "scim_token_",
+			SigningCertificate: SigningCertificateConfig{
+				DisplayName:   "CN=ucs-idp-{unique_id}",
+				Validity:      "26280h",
+				RotateBefore:  "720h",
+				CheckInterval: "24h",
+			},
+			Polling: PollingConfig{
+				InitialInterval:    "2s",
+				MaxInterval:        "30s",
+				Jitter:             "0.2",
+				ApplicationTimeout: "5m",
+				JobTimeout:         "3m",
+				WriteProbe:         WriteProbeConditional,
+			},
+			Application: ApplicationConfig{
+				DisplayNamePattern: "ucs-idp-{unique_id}",
+				Notes:              "Created by UCS for idp {unique_id} on {date}",
+			},
+		},
+		Google: GoogleConfig{
+			ClientSecretName: "google_client_secret",
+			RedirectURI:      "http://localhost:8080/auth/callback",
+			AuthURI:          "https://accounts.google.com/o/oauth2/auth",
+			TokenURI:         "https://oauth2.googleapis.com/token",
+		},
+		Secrets: SecretsConfig{
+			Provider:  SecretProviderEnv,
+			EnvPrefix: "IDP_SECRET_",
+		},
+		Store: StoreConfig{
+			Backend: StoreBackendMemory,
+			Path:    "./idp-test-go.db",
+		},
+		Vault: VaultConfig{
+			RotateInterval: "24h",
+			Retention:      "2160h",
+		},
+	}
+}
+
+// field binds one config value to its file key, environment variable and flag.
+type field struct {
+	key      string
+	value    *string
+	required bool
+	usage    string
+}
+
+func (f field) env() string {
+	return "IDP_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(f.key))
+}
+
+func (f field) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+func (c *Config) fields() []field {
+	return []field{
+		{key: "server.port", value: &c.Server.Port, required: true, usage: "http listen port"},
+		{key: "ucs.base_url", value: &c.UCS.BaseURL, required: true, usage: "ucs base url"},
+		{key: "ucs.api_key_name", value: &c.UCS.APIKeyName, required: true, usage: "secret name of the ucs api key"},
+		{key: "entra.client_id", value: &c.Entra.ClientID, required: true, usage: "entra bootstrap app client id"},
+		{key: "entra.auth_method", value: &c.Entra.AuthMethod, required: true, usage: "entra client authentication: secret or certificate"},
+		{key: "entra.client_secret_name", value: &c.Entra.ClientSecretName, usage: "secret name of the entra client secret"},
+		{key: "entra.certificate_file", value: &c.Entra.CertificateFile, usage: "PEM or PFX certificate of the entra client"},
+		{key: "entra.certificate_password_name", value: &c.Entra.CertificatePasswordName, usage: "secret name of the certificate password"},
+		{key: "entra.redirect_uri", value: &c.Entra.RedirectURI, required: true, usage: "entra redirect uri"},
+		{key: "entra.auth_uri", value: &c.Entra.AuthURI, usage: "entra authorize endpoint, overrides the cloud default"},
+		{key: "entra.token_uri", value: &c.Entra.TokenURI, usage: "entra token endpoint, overrides the cloud default"},
+		{key: "entra.cloud", value: &c.Entra.Cloud, required: true, usage: "national cloud: global, usgov or china"},
+		{key: "entra.onboarding_steps", value: &c.Entra.OnboardingSteps, usage: "onboarding steps run after consent, comma separated or all"},
+		{key: "entra.on_failure", value: &c.Entra.OnFailure, required: true, usage: "on onboarding failure: resume or rollback"},
+		{key: "entra.signing_certificate.display_name", value: &c.Entra.SigningCertificate.DisplayName, required: true, usage: "saml signing certificate subject"},
+		{key: "entra.signing_certificate.validity", value: &c.Entra.SigningCertificate.Validity, required: true, usage: "saml signing certificate validity"},
+		{key: "entra.signing_certificate.rotate_before", value: &c.Entra.SigningCertificate.RotateBefore, required: true, usage: "rotate saml signing certificates expiring within"},
+		{key: "entra.signing_certificate.check_interval", value: &c.Entra.SigningCertificate.CheckInterval, required: true, usage: "saml signing certificate rotation check interval, 0 to disable"},
+		{key: "entra.claims_file", value: &c.Entra.ClaimsFile, usage: "saml claims spec JSON file"},
+		{key: "entra.metadata_dir", value: &c.Entra.MetadataDir, usage: "directory of the federation metadata store"},
+		{key: "entra.polling.initial_interval", value: &c.Entra.Polling.InitialInterval, required: true, usage: "delay before the second readiness check"},
+		{key: "entra.polling.max_interval", value: &c.Entra.Polling.MaxInterval, required: true, usage: "maximum delay between readiness checks"},
+		{key: "entra.polling.jitter", value: &c.Entra.Polling.Jitter, required: true, usage: "fraction of each readiness check delay randomized"},
+		{key: "entra.polling.application_timeout", value: &c.Entra.Polling.ApplicationTimeout, required: true, usage: "application readiness deadline"},
+		{key: "entra.polling.job_timeout", value: &c.Entra.Polling.JobTimeout, required: true, usage: "synchronization job readiness deadline"},
+		{key: "entra.polling.write_probe", value: &c.Entra.Polling.WriteProbe, required: true, usage: "application write readiness check: conditional, noop, notes or none"},
+		{key: "entra.application.template_id", value: &c.Entra.Application.TemplateID, usage: "application template id"},
+		{key: "entra.application.display_name_pattern", value: &c.Entra.Application.DisplayNamePattern, usage: "application display name pattern"},
+		{key: "entra.application.notes", value: &c.Entra.Application.Notes, usage: "application notes"},
+		{key: "entra.application.tags", value: &c.Entra.Application.Tags, usage: "comma separated application tags"},
+		{key: "entra.application.logo_file", value: &c.Entra.Application.LogoFile, usage: "application logo file"},
+		{key: "entra.application.owners", value: &c.Entra.Application.Owners, usage: "comma separated application owner object ids"},
+		{key: "entra.scim_token_secret_prefix", value: &c.Entra.ScimTokenSecretPrefix, usage: "secret name prefix of scim tokens"},
+		{key: "google.client_id", value: &c.Google.ClientID, usage: "google oauth client id"},
+		{key: "google.client_secret_name", value: &c.Google.ClientSecretName, usage: "secret name of the google client secret"},
+		{key: "google.redirect_uri", value: &c.Google.RedirectURI, usage: "google redirect uri"},
+		{key: "google.auth_uri", value: &c.Google.AuthURI, usage: "google authorize endpoint"},
+		{key: "google.token_uri", value: &c.Google.TokenURI, usage: "google token endpoint"},
+		{key: "secrets.provider", value: &c.Secrets.Provider, required: true, usage: "secret provider: env, file or encrypted"},
+		{key: "secrets.env_prefix", value: &c.Secrets.EnvPrefix, usage: "env variable prefix of the env secret provider"},
+		{key: "secrets.dir", value: &c.Secrets.Dir, usage: "secrets directory of the file and encrypted providers"},
+		{key: "secrets.key_file", value: &c.Secrets.KeyFile, usage: "key file of the encrypted secret provider"},
+		{key: "store.backend", value: &c.Store.Backend, required: true, usage: "state and token store: memory, bolt or redis"},
+		{key: "store.path", value: &c.Store.Path, usage: "database file of the bolt store"},
+		{key: "store.redis_url", value: &c.Store.RedisURL, usage: "url of the redis store"},
+		{key: "store.redis_password_name", value: &c.Store.RedisPasswordName, usage: "secret name of the redis password"},
+		{key: "vault.key_dir", value: &c.Vault.KeyDir, usage: "directory of the token vault keys"},
+		{key: "vault.rotate_interval", value: &c.Vault.RotateInterval, required: true, usage: "token vault key rotation interval"},
+		{key: "vault.retention", value: &c.Vault.Retention, required: true, usage: "longest lifetime of a sealed token"},
+	}
+}
+
+// Load resolves the configuration from defaults, the file given by -config or
+// IDP_CONFIG_FILE, environment variables and command line flags, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("idp-test-go", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("IDP_CONFIG_FILE"), "path to JSON config file")
+	flagValues := make(map[string]*string)
+	for _, f := range cfg.fields() {
+		flagValues[f.flag()] = fs.String(f.flag(), "", f.usage+" (env "+f.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := cfg.fields()
+	for _, f := range fields {
+		if v, ok := os.LookupEnv(f.env()); ok {
+			*f.value = v
+		}
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	for _, f := range fields {
+		if set[f.flag()] {
+			*f.value = *flagValues[f.flag()]
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("config: parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every required value that is missing.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, f := range c.fields() {
+		if f.required && strings.TrimSpace(*f.value) == "" {
+			errs = append(errs, missing(f))
+		}
+	}
+	errs = append(errs, c.Entra.Validate(), c.Secrets.Validate(), c.Store.Validate(), c.Vault.Validate())
+	return errors.Join(errs...)
+}
+
+// Validate checks the settings the selected auth method needs.
+func (e EntraConfig) Validate() error {
+	if err := e.Polling.Validate(); err != nil {
+		return err
+	}
+	if err := e.SigningCertificate.Validate(); err != nil {
+		return err
+	}
+	if err := e.Application.Validate(); err != nil {
+		return err
+	}
+	switch e.Cloud {
+	case CloudGlobal, CloudUSGov, CloudChina:
+	default:
+		return fmt.Errorf("config: unknown entra.cloud %q, want global, usgov or china", e.Cloud)
+	}
+	if e.OnFailure != OnFailureResume && e.OnFailure != OnFailureRollback {
+		return fmt.Errorf("config: unknown entra.on_failure %q, want resume or rollback", e.OnFailure)
+	}
+	switch e.AuthMethod {
+	case AuthMethodSecret:
+		if e.ClientSecretName == "" {
+			return errors.New("config: entra.client_secret_name is required by the secret auth method")
+		}
+	case AuthMethodCertificate:
+		if e.CertificateFile == "" {
+			return errors.New("config: entra.certificate_file is required by the certificate auth method")
+		}
+	default:
+		return fmt.Errorf("config: unknown entra.auth_method %q, want secret or certificate", e.AuthMethod)
+	}
+	return nil
+}
+
+// Validate checks the settings the selected provider needs.
+func (s SecretsConfig) Validate() error {
+	var errs []error
+	switch s.Provider {
+	case SecretProviderEnv:
+	case SecretProviderFile:
+		if s.Dir == "" {
+			errs = append(errs, errors.New("config: secrets.dir is required by the file secret provider"))
+		}
+	case SecretProviderEncrypted:
+		if s.Dir == "" {
+			errs = append(errs, errors.New("config: secrets.dir is required by the encrypted secret provider"))
+		}
+		if s.KeyFile == "" {
+			errs = append(errs, errors.New("config: secrets.key_file is required by the encrypted secret provider"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("config: unknown secrets.provider %q, want env, file or encrypted", s.Provider))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the settings the selected backend needs.
+func (s StoreConfig) Validate() error {
+	switch s.Backend {
+	case StoreBackendMemory:
+	case StoreBackendBolt:
+		if s.Path == "" {
+			return errors.New("config: store.path is required by the bolt store")
+		}
+	case StoreBackendRedis:
+		if s.RedisURL == "" {
+			return errors.New("config: store.redis_url is required by the redis store")
+		}
+	default:
+		return fmt.Errorf("config: unknown store.backend %q, want memory, bolt or redis", s.Backend)
+	}
+	return nil
+}
+
+// Validate reports every value the google flow needs that is missing.
+func (g GoogleConfig) Validate() error {
+	c := &Config{Google: g}
+	var errs []error
+	for _, f := range c.fields() {
+		if strings.HasPrefix(f.key, "google.") && strings.TrimSpace(*f.value) == "" {
+			errs = append(errs, missing(f))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func missing(f field) error {
+	return fmt.Errorf("config: missing required value %s (set %q in the config file, env %s or flag -%s)",
+		f.key, f.key, f.env(), f.flag())
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{"server": {"port": "8081"}, "ucs": {"base_url": "http://file"}, "entra": {"client_id": "file-client"}}`)
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		wantPort string
+		wantUCS  string
+	}{
+		{
+			name:     "default",
+			args:     []string{"-ucs-base-url", "http://flag", "-entra-client-id", "flag-client"},
+			wantPort: "8080",
+			wantUCS:  "http://flag",
+		},
+		{
+			name:     "file over default",
+			args:     []string{"-config", file},
+			wantPort: "8081",
+			wantUCS:  "http://file",
+		},
+		{
+			name:     "env over file",
+			env:      map[string]string{"IDP_SERVER_PORT": "8082"},
+			args:     []string{"-config", file},
+			wantPort: "8082",
+			wantUCS:  "http://file",
+		},
+		{
+			name:     "flag over env",
+			env:      map[string]string{"IDP_SERVER_PORT": "8082", "IDP_UCS_BASE_URL": "http://env"},
+			args:     []string{"-config", file, "-server-port", "8083"},
+			wantPort: "8083",
+			wantUCS:  "http://env",
+		},
+		{
+			name:     "config file from env",
+			env:      map[string]string{"IDP_CONFIG_FILE": file},
+			wantPort: "8081",
+			wantUCS:  "http://file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Server.Port != tt.wantPort {
+				t.Errorf("server.port = %q, want %q", cfg.Server.Port, tt.wantPort)
+			}
+			if cfg.UCS.BaseURL != tt.wantUCS {
+				t.Errorf("ucs.base_url = %q, want %q", cfg.UCS.BaseURL, tt.wantUCS)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		wantErr []string
+	}{
+		{
+			name:    "missing required values",
+			args:    []string{},
+			wantErr: []string{"ucs.base_url", "IDP_UCS_BASE_URL", "-entra-client-id"},
+		},
+		{
+			name:    "empty flag overrides file",
+			file:    `{"ucs": {"base_url": "http://file"}, "entra": {"client_id": "file-client"}}`,
+			args:    []string{"-ucs-base-url", ""},
+			wantErr: []string{"ucs.base_url"},
+		},
+		{
+			name:    "malformed file",
+			file:    `{"server": `,
+			wantErr: []string{"config: parse"},
+		},
+		{
+			name:    "secret provider settings",
+			args:    []string{"-ucs-base-url", "http://flag", "-entra-client-id", "flag-client", "-secrets-provider", "encrypted"},
+			wantErr: []string{"secrets.dir", "secrets.key_file"},
+		},
+		{
+			name:    "unknown secret provider",
+			args:    []string{"-ucs-base-url", "http://flag", "-entra-client-id", "flag-client", "-secrets-provider", "vault"},
+			wantErr: []string{`unknown secrets.provider "vault"`},
+		},
+		{
+			name:    "date in display name pattern",
+			args:    []string{"-ucs-base-url", "http://flag", "-entra-client-id", "flag-client", "-entra-application-display-name-pattern", "idp-{unique_id}-{date}"},
+			wantErr: []string{"display_name_pattern", "{date}"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, err := Load(args)
+			if err == nil {
+				t.Fatal("Load succeeded, want error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
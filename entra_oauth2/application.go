@@ -7,56 +7,160 @@ import (
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/go-resty/resty/v2"
 	"github.com/google/uuid"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/applications"
 	"github.com/microsoftgraph/msgraph-sdk-go/applicationtemplates"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/microsoftgraph/msgraph-sdk-go/serviceprincipals"
+	"idp-test-go/config"
+	"idp-test-go/poll"
 	"log"
-	"os"
-	"path/filepath"
+	"net/http"
 	"strings"
 	"time"
 )
 
-func (s *EntraService) createApplication(ctx context.Context) (models.Applicationable, models.ServicePrincipalable, error) {
+// applicationTag 标记由该 idp 创建的应用程序, 用于重复执行时查找已有应用
+func applicationTag(idpConfig *IdpConfig) string {
+	return "ucs-idp:" + idpConfig.UniqueID
+}
+
+func (s *EntraService) createApplication(ctx context.Context, spec ApplicationSpec, idpConfig *IdpConfig, record *WorkflowRecord) (models.Applicationable, models.ServicePrincipalable, error) {
 
 	log.Printf("🔄 开始创建应用程序")
 
-	app, sp, err := s.instantiateApplicationTemplate(ctx)
-	if err != nil {
-		return nil, nil, fmt.Errorf("实例化应用程序模板失败: %w", err)
+	var app models.Applicationable
+	var sp models.ServicePrincipalable
+	var err error
+	if record.AppID != "" && record.ServicePrincipalID != "" {
+		// 上次执行已实例化, 复用已创建的应用程序
+		log.Printf("♻️  复用已创建的应用程序, App ID: %s, SP ID: %s", record.AppID, record.ServicePrincipalID)
+		app, sp, err = s.getApplication(ctx, record.AppID, record.ServicePrincipalID)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// 第一步：查找该 idp 已创建的应用程序, 不存在时实例化模板
+		app, sp, err = s.findApplication(ctx, spec, idpConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("查找已有应用程序失败: %w", err)
+		}
+		if app != nil {
+			log.Printf("♻️  复用已存在的应用程序, App ID: %s, SP ID: %s", *app.GetId(), *sp.GetId())
+		} else {
+			app, sp, err = s.instantiateApplicationTemplate(ctx, spec.TemplateID, spec.displayName(idpConfig))
+			if err != nil {
+				return nil, nil, fmt.Errorf("实例化应用程序模板失败: %w", err)
+			}
+			log.Printf("✅ 应用程序模板实例化成功")
+			log.Printf("📋 App ID: %s, SP ID: %s", *app.GetId(), *sp.GetId())
+		}
+		record.AppID = *app.GetId()
+		record.AppClientID = *app.GetAppId()
+		record.ServicePrincipalID = *sp.GetId()
 	}
 
-	log.Printf("✅ 应用程序模板实例化成功")
-	log.Printf("📋 App ID: %s, SP ID: %s", *app.GetId(), *sp.GetId())
-
 	// 第二步：等待应用程序完全创建完成
 	if err := s.waitForApplicationReady(ctx, app, sp); err != nil {
 		return nil, nil, fmt.Errorf("等待应用程序就绪失败: %w", err)
 	}
 
+	// 第三步：设置标签、备注、logo 和所有者, 之后重复执行可按 idp 标签找到该应用
+	if err := s.applyApplicationSpec(ctx, app, sp, spec, idpConfig); err != nil {
+		return nil, nil, fmt.Errorf("配置应用程序失败: %w", err)
+	}
+
 	log.Printf("✅ 应用程序创建完成并就绪")
 	return app, sp, nil
 }
 
+// findApplication 按标签查找该 idp 已创建的应用程序及其服务主体, 显示名称包含 {unique_id} 时
+// 再按显示名称查找 (打标签前中断的应用), 不存在时返回 nil
+func (s *EntraService) findApplication(ctx context.Context, spec ApplicationSpec, idpConfig *IdpConfig) (models.Applicationable, models.ServicePrincipalable, error) {
+	filters := []string{
+		fmt.Sprintf("tags/any(t:t eq '%s')", odataString(applicationTag(idpConfig))),
+	}
+	if spec.displayNameIdentifiesIdp() {
+		filters = append(filters, fmt.Sprintf("displayName eq '%s'", odataString(spec.displayName(idpConfig))))
+	}
+	var app models.Applicationable
+	for _, filter := range filters {
+		apps, err := s.graphClient.Applications().Get(ctx, &applications.ApplicationsRequestBuilderGetRequestConfiguration{
+			QueryParameters: &applications.ApplicationsRequestBuilderGetQueryParameters{
+				Filter: pointer(filter),
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if values := apps.GetValue(); len(values) > 0 {
+			if len(values) > 1 {
+				log.Printf("⚠️  %d applications match %s, using %s", len(values), filter, *values[0].GetId())
+			}
+			app = values[0]
+			break
+		}
+	}
+	if app == nil {
+		return nil, nil, nil
+	}
+
+	sps, err := s.graphClient.ServicePrincipals().Get(ctx, &serviceprincipals.ServicePrincipalsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &serviceprincipals.ServicePrincipalsRequestBuilderGetQueryParameters{
+			Filter: pointer(fmt.Sprintf("appId eq '%s'", odataString(*app.GetAppId()))),
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if values := sps.GetValue(); len(values) > 0 {
+		return app, values[0], nil
+	}
+
+	// 应用程序存在但服务主体缺失, 补建服务主体
+	newSp := models.NewServicePrincipal()
+	newSp.SetAppId(app.GetAppId())
+	sp, err := s.graphClient.ServicePrincipals().Post(ctx, newSp, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建服务主体失败: %w", err)
+	}
+	return app, sp, nil
+}
+
+// odataString 转义 OData 过滤条件中的字符串字面量
+func odataString(value string) string {
+	return strings.ReplaceAll(value, "'", "''")
+}
+
+// getApplication 读取已创建的应用程序和服务主体
+func (s *EntraService) getApplication(ctx context.Context, appID, spID string) (models.Applicationable, models.ServicePrincipalable, error) {
+	app, err := s.graphClient.Applications().ByApplicationId(appID).Get(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取应用程序失败: %w", err)
+	}
+	sp, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Get(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取服务主体失败: %w", err)
+	}
+	return app, sp, nil
+}
+
 // instantiateApplicationTemplate 实例化应用程序模板
-func (s *EntraService) instantiateApplicationTemplate(ctx context.Context) (models.Applicationable, models.ServicePrincipalable, error) {
+func (s *EntraService) instantiateApplicationTemplate(ctx context.Context, templateID, displayName string) (models.Applicationable, models.ServicePrincipalable, error) {
 	// 创建实例化请求
 	instantiatePostRequestBody := applicationtemplates.NewItemInstantiatePostRequestBody()
 
-	// 生成唯一的显示名称
-	instantiatePostRequestBody.SetDisplayName(pointer("xin-auto-1234"))
-
-	// 添加附加属性
-	properties := make(map[string]interface{})
-	properties["notes"] = fmt.Sprintf("Created via API at %s", time.Now().Format(time.RFC3339))
-	instantiatePostRequestBody.SetAdditionalData(properties)
+	// 设置显示名称
+	instantiatePostRequestBody.SetDisplayName(pointer(displayName))
 
 	// 调用API创建应用程序
-	templateID := "8adf8e6e-67b2-4cf2-a259-e3dc5476c621" // custom template
 	result, err := s.graphClient.ApplicationTemplates().
 		ByApplicationTemplateId(templateID).
 		Instantiate().
 		Post(ctx, instantiatePostRequestBody, nil)
+	if isNotFound(err) {
+		return nil, nil, newOnboardingError(ErrTemplateNotFound, fmt.Errorf("模板 %s: %w", templateID, err))
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("调用实例化API失败: %w", err)
 	}
@@ -75,102 +179,75 @@ func (s *EntraService) instantiateApplicationTemplate(ctx context.Context) (mode
 }
 
 func (s *EntraService) waitForApplicationReady(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable) error {
-	log.Printf("⏳ 等待应用程序完全就绪...")
-
-	// 创建带超时的上下文
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	defer cancel()
-
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	startTime := time.Now()
-
-	for {
-		select {
-		case <-timeoutCtx.Done():
-			return fmt.Errorf("等待应用程序就绪超时，已等待 %v", time.Since(startTime))
-		case <-ticker.C:
-			// 检查应用程序是否就绪
-			ready, err := s.checkApplicationReady(ctx, app, sp)
-			if err != nil {
-				log.Printf("⚠️  检查应用程序状态时出错: %v", err)
-				continue
-			}
-
-			if ready {
-				elapsed := time.Since(startTime)
-				log.Printf("✅ 应用程序已就绪，耗时: %v", elapsed)
-				return nil
-			}
-
-			log.Printf("🔄 应用程序尚未就绪，继续等待... (已等待 %v)", time.Since(startTime))
-		}
-	}
-}
-
-func (s *EntraService) checkApplicationReady(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable) (bool, error) {
 	appID := app.GetId()
 	spID := sp.GetId()
-
 	if appID == nil || spID == nil {
-		return false, fmt.Errorf("应用程序或服务主体ID为空")
+		return fmt.Errorf("应用程序或服务主体ID为空")
 	}
 
-	// 检查1：尝试读取应用程序
-	if !s.checkApplicationAccessible(ctx, *appID) {
-		return false, nil
-	}
-
-	// 检查2：尝试读取服务主体
-	if !s.checkServicePrincipalAccessible(ctx, *spID) {
-		return false, nil
+	log.Printf("⏳ 等待应用程序完全就绪...")
+	applicationTimeout, _ := s.cfg.Polling.Timeouts()
+	probes := []poll.Probe{
+		s.applicationAccessibleProbe(*appID),
+		s.servicePrincipalAccessibleProbe(*spID),
 	}
-
-	// 检查3：尝试更新应用程序（测试写权限）
-	if !s.checkApplicationUpdatable(ctx, *appID) {
-		return false, nil
+	if s.cfg.Polling.WriteProbe != config.WriteProbeNone {
+		probes = append(probes, s.applicationUpdatableProbe(*appID))
 	}
-
-	// 所有检查都通过
-	return true, nil
+	return s.poller(applicationTimeout).Wait(ctx, poll.All("应用程序", probes...))
 }
 
-func (s *EntraService) checkApplicationAccessible(ctx context.Context, appID string) bool {
-	_, err := s.graphClient.Applications().ByApplicationId(appID).Get(ctx, nil)
-	if err != nil {
-		log.Printf("🔍 应用程序不可访问: %v", err)
-		return false
-	}
-	return true
+// applicationAccessibleProbe 检查应用程序是否可读取
+func (s *EntraService) applicationAccessibleProbe(appID string) poll.Probe {
+	return poll.Probe{Name: "应用程序可访问", Check: func(ctx context.Context) (bool, error) {
+		_, err := s.graphClient.Applications().ByApplicationId(appID).Get(ctx, nil)
+		return err == nil, pollError(err)
+	}}
 }
 
-// checkServicePrincipalAccessible 检查服务主体是否可访问
-func (s *EntraService) checkServicePrincipalAccessible(ctx context.Context, spID string) bool {
-	_, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Get(ctx, nil)
-	if err != nil {
-		log.Printf("🔍 服务主体不可访问: %v", err)
-		return false
-	}
-	return true
+// servicePrincipalAccessibleProbe 检查服务主体是否可读取
+func (s *EntraService) servicePrincipalAccessibleProbe(spID string) poll.Probe {
+	return poll.Probe{Name: "服务主体可访问", Check: func(ctx context.Context) (bool, error) {
+		_, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Get(ctx, nil)
+		return err == nil, pollError(err)
+	}}
 }
 
-// checkApplicationUpdatable 检查应用程序是否可更新
-func (s *EntraService) checkApplicationUpdatable(ctx context.Context, appID string) bool {
-	// 创建一个简单的更新操作来测试
-	updateApp := models.NewApplication()
-	updateApp.SetNotes(pointer(fmt.Sprintf("Readiness check at %s", time.Now().Format(time.RFC3339))))
+// writeProbeETag 不会匹配任何对象的 entity tag
+const writeProbeETag = `"idp-readiness-probe"`
+
+// applicationUpdatableProbe 检查应用程序是否可更新.
+// 默认 (conditional) 发送带 If-Match 的空 PATCH: If-Match 不会匹配, 应用程序传播到写入路径后
+// 返回 412 且不写入, 之前返回 404. Graph 忽略 If-Match 时空 PATCH 同样不修改任何属性.
+// noop 策略发送无条件的空 PATCH, 不修改属性但仍是一次写入, 会记入审计日志;
+// notes 策略保留旧行为, 每次检查都改写备注.
+func (s *EntraService) applicationUpdatableProbe(appID string) poll.Probe {
+	return poll.Probe{Name: "应用程序可更新", Check: func(ctx context.Context) (bool, error) {
+		updateApp := models.NewApplication()
+		requestConfig := &applications.ApplicationItemRequestBuilderPatchRequestConfiguration{}
+		switch s.cfg.Polling.WriteProbe {
+		case config.WriteProbeConditional:
+			requestConfig.Headers = abstractions.NewRequestHeaders()
+			requestConfig.Headers.Add("If-Match", writeProbeETag)
+		case config.WriteProbeNotes:
+			updateApp.SetNotes(pointer(fmt.Sprintf("Readiness check at %s", time.Now().Format(time.RFC3339))))
+		}
+		_, err := s.graphClient.Applications().ByApplicationId(appID).Patch(ctx, updateApp, requestConfig)
+		if graphErr, ok := AsGraphError(err); ok && graphErr.StatusCode == http.StatusPreconditionFailed {
+			// the write path found the application and refused the write
+			return true, nil
+		}
+		return err == nil, pollError(err)
+	}}
+}
 
-	_, err := s.graphClient.Applications().ByApplicationId(appID).Patch(ctx, updateApp, nil)
-	if err != nil {
-		log.Printf("🔍 应用程序不可更新: %v", err)
-		return false
-	}
-	return true
+// samlOrgID 由 idp unique id 派生确定的路径段, 重复执行得到相同的 entity id
+func samlOrgID(idpConfig *IdpConfig) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(applicationTag(idpConfig))).String()
 }
 
 // Set up Single Sign-On with SAML
-func (s *EntraService) configurationSAML(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable, idpConfig *IdpConfig, tokenResult *confidential.AuthResult) error {
+func (s *EntraService) configurationSAML(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable, claims *ClaimsSpec, idpConfig *IdpConfig, tokenResult *confidential.AuthResult, record *WorkflowRecord) error {
 	appID := app.GetId()
 	spID := sp.GetId()
 
@@ -181,17 +258,24 @@ func (s *EntraService) configurationSAML(ctx context.Context, app models.Applica
 	web := models.NewWebApplication()
 	web.SetRedirectUriSettings([]models.RedirectUriSettingsable{setting})
 	updateApp.SetWeb(web)
-	domain := strings.Split(tokenResult.Account.PreferredUsername, "@")[1]
-	orgID := uuid.New().String()
-	updateApp.SetIdentifierUris([]string{fmt.Sprintf("https://%s/saml/%s", domain, orgID)})
-	// TODO HostNameNotOnVerifiedDomain: Values of identifierUris property must use a verified domain of the organization or its subdomain: 'https://01963312-513d-71a9-a671-275f267a4c77.idp.ui.direct/saml/xxxx'
-	//updateApp.SetIdentifierUris([]string{idpConfig.GetEntityID()})
-	// this api unsupported 'api://xxx'
-	//updateApp.SetIdentifierUris([]string{"api://" + idpConfig.UniqueID})
+	// identifierUris must use a verified domain of the organization or its subdomain ('api://xxx' is unsupported)
+	// the entity id chosen by an earlier run is kept, so that ucs and entra keep agreeing on the audience
+	entityID := record.EntityID
+	if entityID == "" {
+		_, upnDomain, _ := strings.Cut(tokenResult.Account.PreferredUsername, "@")
+		var err error
+		entityID, err = s.identifierURI(ctx, idpConfig, upnDomain, samlOrgID(idpConfig))
+		if err != nil {
+			return fmt.Errorf("choose identifier uri failed: %w", err)
+		}
+	}
+	updateApp.SetIdentifierUris([]string{entityID})
+	log.Printf("🔖 SAML identifier uri: %s", entityID)
 	_, err := s.graphClient.Applications().ByApplicationId(*appID).Patch(ctx, updateApp, nil)
 	if err != nil {
-		return fmt.Errorf("update application failed: %s", err.Error())
+		return fmt.Errorf("update application failed: %w", err)
 	}
+	record.EntityID = entityID
 	log.Printf("✅ update application succeed \n")
 
 	// update ServicePrincipal
@@ -203,45 +287,42 @@ func (s *EntraService) configurationSAML(ctx context.Context, app models.Applica
 	updateSp.SetReplyUrls([]string{idpConfig.GetReplyURL()})
 	_, err = s.graphClient.ServicePrincipals().ByServicePrincipalId(*spID).Patch(ctx, updateSp, nil)
 	if err != nil {
-		return fmt.Errorf("update ServicePrincipal failed: %s", err.Error())
+		return fmt.Errorf("update ServicePrincipal failed: %w", err)
 	}
 	log.Printf("✅ update ServicePrincipal succeed \n")
 
-	// SAML Certificates - add TokenSigningCertificate
-	addTokenSigningCertificate := serviceprincipals.NewItemAddTokenSigningCertificatePostRequestBody()
-	tokenSigningCertificate, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(*sp.GetId()).
-		AddTokenSigningCertificate().Post(ctx, addTokenSigningCertificate, nil)
-	if err != nil {
-		return fmt.Errorf("add tokenSigningCertificate failed: %s", err.Error())
+	// NameID, attribute and group claims
+	if claims != nil {
+		if err := s.configureClaims(ctx, app, sp, claims, idpConfig, record); err != nil {
+			return err
+		}
 	}
-	log.Printf("✅ add tokenSigningCertificate succeed: %s\n", *tokenSigningCertificate.GetKeyId())
 
-	// download XML
-	outputDir := "./saml-config"
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Fatal("Error creating output directory:", err)
-	}
-	outputFile := filepath.Join(outputDir, "federationmetadata.xml")
-	metadataURL := fmt.Sprintf("https://login.microsoftonline.com/common/federationmetadata/2007-06/federationmetadata.xml?appid=%s", *sp.GetAppId())
-	log.Printf("Federation Metadata URL: %s\n", metadataURL)
-	resp, err := resty.New().R().
-		SetOutput(outputFile).
-		Get(metadataURL)
-	if err != nil {
-		log.Println("Error downloading federation metadata:", err)
-		return err
-	}
-	if resp.IsSuccess() {
-		log.Printf("✅ Federation Metadata XML: %s\n", outputFile)
+	// SAML Certificates - add and activate TokenSigningCertificate, once per application
+	if record.CertKeyID == "" {
+		cert, err := s.addSigningCertificate(ctx, *sp.GetId(), idpConfig)
+		if err != nil {
+			return fmt.Errorf("add tokenSigningCertificate failed: %w", err)
+		}
+		// a new application has no metadata at ucs yet, activate at once
+		if err := s.activateSigningCertificate(ctx, *sp.GetId(), cert.Thumbprint); err != nil {
+			return err
+		}
+		record.CertKeyID = cert.KeyID
 	} else {
-		return errors.New(fmt.Sprintf("Federation Metadata XML failed，code: %d", resp.StatusCode()))
+		log.Printf("♻️  tokenSigningCertificate already added: %s\n", record.CertKeyID)
 	}
 
 	// add idP
-	err = s.addIdp(ctx, outputFile, map[string]string{
+	scimToken, err := s.scimToken(ctx, idpConfig)
+	if err != nil {
+		return err
+	}
+	err = s.publishFederationMetadata(ctx, record.TenantID, *sp.GetAppId(), *spID, map[string]string{
 		"system_key": "office365",
 		"unique_id":  idpConfig.UniqueID,
-		"scim_token": idpConfig.ScimToken,
+		"scim_token": scimToken,
+		"entity_id":  entityID,
 	})
 	if err != nil {
 		log.Println("UCS Provisioning Setup failed:", err)
@@ -251,3 +332,43 @@ func (s *EntraService) configurationSAML(ctx context.Context, app models.Applica
 
 	return nil
 }
+
+// publishFederationMetadata 下载并校验应用的联合元数据, 存入元数据仓库后随 formData 一起提交给 UCS
+func (s *EntraService) publishFederationMetadata(ctx context.Context, tenantID, appClientID, spID string, formData map[string]string) error {
+	data, err := s.downloadFederationMetadata(ctx, tenantID, appClientID)
+	if err != nil {
+		return err
+	}
+	if err := s.validateFederationMetadata(ctx, data, spID, tenantID); err != nil {
+		return err
+	}
+	s.storeFederationMetadata(ctx, tenantID, appClientID, data)
+	return s.addIdp(ctx, data, formData)
+}
+
+// storeFederationMetadata 将推送给 UCS 的联合元数据存入元数据仓库.
+// 仓库只用于留存历史, 写入失败不影响推送
+func (s *EntraService) storeFederationMetadata(ctx context.Context, tenantID, appClientID string, data []byte) {
+	if rev, err := s.metadataStore.Put(ctx, tenantID, appClientID, data); err != nil {
+		log.Printf("⚠️  store federation metadata failed: %v", err)
+	} else {
+		log.Printf("✅ Federation Metadata XML stored: %s/%s@%s", tenantID, appClientID, rev.Digest[:12])
+	}
+}
+
+// downloadFederationMetadata 从租户的元数据地址下载应用的联合元数据, 只保留在内存中.
+// /common 地址返回的 entityID 是 {tenantid} 占位符, 无法校验颁发者
+func (s *EntraService) downloadFederationMetadata(ctx context.Context, tenantID, appClientID string) ([]byte, error) {
+	metadataURL := s.cloud.FederationMetadataURL(tenantID, appClientID)
+	log.Printf("Federation Metadata URL: %s\n", metadataURL)
+	resp, err := resty.New().R().SetContext(ctx).
+		Get(metadataURL)
+	if err != nil {
+		log.Println("Error downloading federation metadata:", err)
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, errors.New(fmt.Sprintf("Federation Metadata XML failed，code: %d", resp.StatusCode()))
+	}
+	return resp.Body(), nil
+}
@@ -0,0 +1,234 @@
+package entra_oauth2
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"idp-test-go/config"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const customApplicationTemplateID = "8adf8e6e-67b2-4cf2-a259-e3dc5476c621" // custom (non-gallery) template
+
+// ApplicationSpec 描述实例化的企业应用.
+// DisplayNamePattern 和 Notes 中的 {unique_id} 替换为 idp unique id, Notes 中的 {date} 替换为当前日期.
+// 显示名称用于重复执行时查找已有应用, 不允许包含 {date}.
+type ApplicationSpec struct {
+	// application template id, the custom non-gallery template by default
+	TemplateID string
+
+	DisplayNamePattern string
+	Notes              string
+
+	// extra tags, the idp tag is always added
+	Tags []string
+
+	// png/jpeg logo file uploaded after creation
+	LogoFile string
+
+	// object ids of users or service principals added as owners of the application and service principal
+	Owners []string
+}
+
+// DefaultApplicationSpec 返回配置中的应用参数
+func DefaultApplicationSpec(cfg config.ApplicationConfig) ApplicationSpec {
+	spec := ApplicationSpec{
+		TemplateID:         cfg.TemplateID,
+		DisplayNamePattern: cfg.DisplayNamePattern,
+		Notes:              cfg.Notes,
+		Tags:               splitList(cfg.Tags),
+		LogoFile:           cfg.LogoFile,
+		Owners:             splitList(cfg.Owners),
+	}
+	if spec.TemplateID == "" {
+		spec.TemplateID = customApplicationTemplateID
+	}
+	if spec.DisplayNamePattern == "" {
+		spec.DisplayNamePattern = "ucs-idp-{unique_id}"
+	}
+	return spec
+}
+
+// 登录请求中可覆盖的应用参数. logo 是服务器上的文件, 只能通过配置指定
+var applicationParams = []string{"template_id", "display_name_pattern", "notes", "tags", "owners"}
+
+// loginApplicationParams 返回登录请求中给出的应用参数
+func loginApplicationParams(query url.Values) map[string]string {
+	params := make(map[string]string)
+	for _, name := range applicationParams {
+		if value := strings.TrimSpace(query.Get(name)); value != "" {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// applicationSpec 返回本次接入的应用参数: 配置中的参数, 由登录请求中给出的参数覆盖
+func (s *EntraService) applicationSpec(params map[string]string) ApplicationSpec {
+	spec := DefaultApplicationSpec(s.cfg.Application)
+	if value, exist := params["template_id"]; exist {
+		spec.TemplateID = value
+	}
+	if value, exist := params["display_name_pattern"]; exist {
+		spec.DisplayNamePattern = value
+	}
+	if value, exist := params["notes"]; exist {
+		spec.Notes = value
+	}
+	if value, exist := params["tags"]; exist {
+		spec.Tags = splitList(value)
+	}
+	if value, exist := params["owners"]; exist {
+		spec.Owners = splitList(value)
+	}
+	return spec
+}
+
+// Validate 检查模板 id 格式和显示名称是否确定
+func (spec ApplicationSpec) Validate() error {
+	if _, err := uuid.Parse(spec.TemplateID); err != nil {
+		return fmt.Errorf("invalid application template id %q", spec.TemplateID)
+	}
+	if strings.Contains(spec.DisplayNamePattern, "{date}") {
+		return fmt.Errorf("display name pattern %q must not contain {date}", spec.DisplayNamePattern)
+	}
+	return nil
+}
+
+func (spec ApplicationSpec) expand(pattern string, idpConfig *IdpConfig) string {
+	return strings.NewReplacer(
+		"{unique_id}", idpConfig.UniqueID,
+		"{date}", time.Now().Format(time.DateOnly),
+	).Replace(pattern)
+}
+
+// displayName 生成确定的显示名称, 重复执行时用于查找已有应用
+func (spec ApplicationSpec) displayName(idpConfig *IdpConfig) string {
+	return strings.ReplaceAll(spec.DisplayNamePattern, "{unique_id}", idpConfig.UniqueID)
+}
+
+// displayNameIdentifiesIdp 显示名称包含 idp unique id 时才能按名称认领已有应用,
+// 否则同一模式下其他 idp 的应用也会匹配
+func (spec ApplicationSpec) displayNameIdentifiesIdp() bool {
+	return strings.Contains(spec.DisplayNamePattern, "{unique_id}")
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// applyApplicationSpec 设置应用的标签、备注、logo 和所有者, 重复执行不会产生重复修改
+func (s *EntraService) applyApplicationSpec(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable, spec ApplicationSpec, idpConfig *IdpConfig) error {
+	appID := *app.GetId()
+
+	// 标签和备注
+	tags := app.GetTags()
+	for _, tag := range append([]string{applicationTag(idpConfig)}, spec.Tags...) {
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	updateApp := models.NewApplication()
+	updateApp.SetTags(tags)
+	if spec.Notes != "" {
+		updateApp.SetNotes(pointer(spec.expand(spec.Notes, idpConfig)))
+	}
+	if _, err := s.graphClient.Applications().ByApplicationId(appID).Patch(ctx, updateApp, nil); err != nil {
+		return fmt.Errorf("update tags and notes failed: %w", err)
+	}
+	app.SetTags(tags)
+	log.Printf("✅ application tags: %s", strings.Join(tags, ", "))
+
+	// logo
+	if spec.LogoFile != "" {
+		if err := s.uploadApplicationLogo(ctx, appID, spec.LogoFile); err != nil {
+			return fmt.Errorf("upload logo failed: %w", err)
+		}
+		log.Printf("✅ application logo uploaded")
+	}
+
+	// 所有者
+	if len(spec.Owners) > 0 {
+		if err := s.addOwners(ctx, appID, *sp.GetId(), spec.Owners); err != nil {
+			return fmt.Errorf("add owners failed: %w", err)
+		}
+		log.Printf("✅ application owners: %s", strings.Join(spec.Owners, ", "))
+	}
+	return nil
+}
+
+func (s *EntraService) uploadApplicationLogo(ctx context.Context, appID, logoFile string) error {
+	logo, err := os.ReadFile(logoFile)
+	if err != nil {
+		return err
+	}
+	requestInfo, err := s.graphClient.Applications().ByApplicationId(appID).Logo().ToPutRequestInformation(ctx, logo, nil)
+	if err != nil {
+		return err
+	}
+	// graph needs the image type, the generated builder always sends application/octet-stream
+	requestInfo.Headers.Remove("Content-Type")
+	requestInfo.Headers.Add("Content-Type", http.DetectContentType(logo))
+	return s.graphClient.GetAdapter().SendNoContent(ctx, requestInfo, abstractions.ErrorMappings{
+		"XXX": odataerrors.CreateODataErrorFromDiscriminatorValue,
+	})
+}
+
+// addOwners 将 owners 添加为应用程序和服务主体的所有者, 已是所有者的跳过
+func (s *EntraService) addOwners(ctx context.Context, appID, spID string, owners []string) error {
+	appOwners, err := s.graphClient.Applications().ByApplicationId(appID).Owners().Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+	spOwners, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Owners().Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		ref := models.NewReferenceCreate()
+		ref.SetOdataId(pointer(s.cloud.GraphURL("/directoryObjects/" + owner)))
+		if !containsDirectoryObject(appOwners.GetValue(), owner) {
+			if err := s.graphClient.Applications().ByApplicationId(appID).Owners().Ref().Post(ctx, ref, nil); err != nil {
+				return fmt.Errorf("application owner %s: %w", owner, err)
+			}
+		}
+		if !containsDirectoryObject(spOwners.GetValue(), owner) {
+			if err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Owners().Ref().Post(ctx, ref, nil); err != nil {
+				return fmt.Errorf("service principal owner %s: %w", owner, err)
+			}
+		}
+	}
+	return nil
+}
+
+func containsDirectoryObject(objects []models.DirectoryObjectable, id string) bool {
+	for _, object := range objects {
+		if object.GetId() != nil && *object.GetId() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
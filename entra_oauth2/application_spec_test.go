@@ -0,0 +1,92 @@
+package entra_oauth2
+
+import (
+	"idp-test-go/config"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApplicationSpecNames(t *testing.T) {
+	idp := &IdpConfig{UniqueID: "idp-1"}
+	today := time.Now().Format(time.DateOnly)
+	tests := []struct {
+		name            string
+		pattern         string
+		wantDisplayName string
+		wantIdentifies  bool
+	}{
+		{"unique id", "ucs-idp-{unique_id}", "ucs-idp-idp-1", true},
+		{"unique id twice", "{unique_id}/{unique_id}", "idp-1/idp-1", true},
+		{"fixed name", "UCS SSO", "UCS SSO", false},
+		{"other placeholder kept", "ucs-{tenant}", "ucs-{tenant}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := ApplicationSpec{DisplayNamePattern: tt.pattern}
+			if got := spec.displayName(idp); got != tt.wantDisplayName {
+				t.Errorf("displayName = %q, want %q", got, tt.wantDisplayName)
+			}
+			if got := spec.displayNameIdentifiesIdp(); got != tt.wantIdentifies {
+				t.Errorf("displayNameIdentifiesIdp = %v, want %v", got, tt.wantIdentifies)
+			}
+		})
+	}
+
+	spec := ApplicationSpec{}
+	if got, want := spec.expand("created for {unique_id} on {date}", idp), "created for idp-1 on "+today; got != want {
+		t.Errorf("expand = %q, want %q", got, want)
+	}
+}
+
+func TestApplicationSpecValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    ApplicationSpec
+		wantErr bool
+	}{
+		{"default", ApplicationSpec{TemplateID: customApplicationTemplateID, DisplayNamePattern: "ucs-idp-{unique_id}"}, false},
+		{"date in display name", ApplicationSpec{TemplateID: customApplicationTemplateID, DisplayNamePattern: "ucs-{unique_id}-{date}"}, true},
+		{"date in notes", ApplicationSpec{TemplateID: customApplicationTemplateID, DisplayNamePattern: "ucs", Notes: "{date}"}, false},
+		{"template id not a guid", ApplicationSpec{TemplateID: "salesforce", DisplayNamePattern: "ucs"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplicationSpecLoginParams(t *testing.T) {
+	s := &EntraService{cfg: config.EntraConfig{Application: config.ApplicationConfig{
+		Notes:    "configured",
+		Tags:     "a",
+		LogoFile: "logo.png",
+	}}}
+	query := url.Values{
+		"display_name_pattern": {"custom-{unique_id}"},
+		"tags":                 {"b, c"},
+		"logo_file":            {"/etc/passwd"},
+		"notes":                {"  "},
+	}
+	spec := s.applicationSpec(loginApplicationParams(query))
+
+	if spec.DisplayNamePattern != "custom-{unique_id}" {
+		t.Errorf("DisplayNamePattern = %q, want the login parameter", spec.DisplayNamePattern)
+	}
+	if !slices.Equal(spec.Tags, []string{"b", "c"}) {
+		t.Errorf("Tags = %v, want [b c]", spec.Tags)
+	}
+	if spec.Notes != "configured" {
+		t.Errorf("Notes = %q, blank login parameter must keep the configured value", spec.Notes)
+	}
+	if spec.LogoFile != "logo.png" {
+		t.Errorf("LogoFile = %q, must only come from the config", spec.LogoFile)
+	}
+	if spec.TemplateID != customApplicationTemplateID {
+		t.Errorf("TemplateID = %q, want the custom template", spec.TemplateID)
+	}
+}
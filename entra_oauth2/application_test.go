@@ -0,0 +1,94 @@
+package entra_oauth2
+
+import (
+	"context"
+	"idp-test-go/config"
+	"idp-test-go/poll"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubGraphService returns a service whose Graph client talks to handler
+func stubGraphService(t *testing.T, handler http.Handler) (*EntraService, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	graphClient, err := NewCloudGraphServiceClient(CloudEnvironment{GraphEndpoint: server.URL},
+		&TokenCredential{Token: "token", ExpiresOn: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &EntraService{graphClient: graphClient}, server
+}
+
+// writeGraphError answers with an OData error
+func writeGraphError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, `{"error": {"code": "`+code+`", "message": "stub"}}`)
+}
+
+func TestApplicationUpdatableProbe(t *testing.T) {
+	tests := []struct {
+		name          string
+		probe         string
+		status        int
+		wantReady     bool
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "conditional refused", probe: config.WriteProbeConditional, status: http.StatusPreconditionFailed, wantReady: true},
+		{name: "conditional ignored", probe: config.WriteProbeConditional, status: http.StatusNoContent, wantReady: true},
+		{name: "conditional not propagated", probe: config.WriteProbeConditional, status: http.StatusNotFound, wantErr: true},
+		{name: "conditional forbidden", probe: config.WriteProbeConditional, status: http.StatusForbidden, wantErr: true, wantPermanent: true},
+		{name: "noop", probe: config.WriteProbeNoop, status: http.StatusNoContent, wantReady: true},
+		{name: "noop bad request", probe: config.WriteProbeNoop, status: http.StatusBadRequest, wantErr: true, wantPermanent: true},
+		{name: "notes", probe: config.WriteProbeNotes, status: http.StatusNoContent, wantReady: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ifMatch, body string
+			calls := 0
+			s, _ := stubGraphService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPatch || r.URL.Path != "/v1.0/applications/app" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				calls++
+				ifMatch = r.Header.Get("If-Match")
+				data, _ := io.ReadAll(r.Body)
+				body = string(data)
+				if tt.status >= 400 {
+					writeGraphError(w, tt.status, "ResourceNotFound")
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			s.cfg.Polling.WriteProbe = tt.probe
+
+			ready, err := s.applicationUpdatableProbe("app").Check(context.Background())
+			if ready != tt.wantReady || (err != nil) != tt.wantErr {
+				t.Fatalf("Check = %v, %v; want ready %v, error %v", ready, err, tt.wantReady, tt.wantErr)
+			}
+			if tt.wantErr {
+				// a permanent error ends the wait at once, others are polled again
+				calls = 0
+				poller := poll.Poller{InitialInterval: 5 * time.Millisecond, Timeout: 50 * time.Millisecond}
+				poller.Wait(context.Background(), s.applicationUpdatableProbe("app"))
+				if permanent := calls == 1; permanent != tt.wantPermanent {
+					t.Errorf("probe polled %d times, want permanent %v", calls, tt.wantPermanent)
+				}
+			}
+
+			if conditional := tt.probe == config.WriteProbeConditional; (ifMatch == writeProbeETag) != conditional {
+				t.Errorf("If-Match = %q with the %s probe", ifMatch, tt.probe)
+			}
+			if notes := strings.Contains(body, "notes"); notes != (tt.probe == config.WriteProbeNotes) {
+				t.Errorf("body %s with the %s probe", body, tt.probe)
+			}
+		})
+	}
+}
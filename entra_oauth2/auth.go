@@ -0,0 +1,30 @@
+package entra_oauth2
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// authorizeUCS 校验 UCS 在变更租户的请求上携带的 API key (Authorization: Bearer <key>).
+// state 只证明曾经登录过, 不足以授权删除或轮换租户资源. 校验失败时已写入响应
+func (s *EntraService) authorizeUCS(w http.ResponseWriter, r *http.Request) bool {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || presented == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "api key missing", http.StatusUnauthorized)
+		return false
+	}
+	apiKey, err := s.secrets.GetSecret(r.Context(), s.ucsAPIKeyName)
+	if err != nil || apiKey == "" {
+		log.Printf("❌ load ucs api key %q failed: %v", s.ucsAPIKeyName, err)
+		http.Error(w, "api key not configured", http.StatusInternalServerError)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(apiKey)) != 1 {
+		http.Error(w, "api key invalid", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
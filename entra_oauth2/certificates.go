@@ -0,0 +1,469 @@
+package entra_oauth2
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/serviceprincipals"
+	"idp-test-go/metadata"
+	"idp-test-go/poll"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningCertificate 是服务主体的 SAML 令牌签名证书
+type SigningCertificate struct {
+	KeyID         string    `json:"key_id"`
+	Thumbprint    string    `json:"thumbprint"`
+	DisplayName   string    `json:"display_name"`
+	StartDateTime time.Time `json:"start_date_time"`
+	EndDateTime   time.Time `json:"end_date_time"`
+
+	// used to sign tokens, i.e. matches preferredTokenSigningKeyThumbprint
+	Active bool `json:"active"`
+
+	// public certificate (DER), only returned when the certificate is added
+	der []byte
+}
+
+// ExpiresWithin 判断证书是否在 d 内过期
+func (c SigningCertificate) ExpiresWithin(d time.Duration) bool {
+	return time.Until(c.EndDateTime) < d
+}
+
+// addSigningCertificate 按配置的名称和有效期添加签名证书, 不改变当前签名证书
+func (s *EntraService) addSigningCertificate(ctx context.Context, spID string, idpConfig *IdpConfig) (*SigningCertificate, error) {
+	body := serviceprincipals.NewItemAddTokenSigningCertificatePostRequestBody()
+	body.SetDisplayName(pointer(signingCertificateName(s.cfg.SigningCertificate.DisplayName, idpConfig)))
+	body.SetEndDateTime(pointer(time.Now().Add(s.cfg.SigningCertificate.ValidFor())))
+	created, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+		AddTokenSigningCertificate().Post(ctx, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	cert := &SigningCertificate{
+		KeyID:       created.GetKeyId().String(),
+		Thumbprint:  strings.ToUpper(stringValue(created.GetThumbprint())),
+		DisplayName: stringValue(created.GetDisplayName()),
+		der:         created.GetKey(),
+	}
+	if created.GetStartDateTime() != nil {
+		cert.StartDateTime = *created.GetStartDateTime()
+	}
+	if created.GetEndDateTime() != nil {
+		cert.EndDateTime = *created.GetEndDateTime()
+	}
+	log.Printf("✅ add tokenSigningCertificate succeed: %s, thumbprint %s, expires %s\n",
+		cert.KeyID, cert.Thumbprint, cert.EndDateTime.Format(time.RFC3339))
+	return cert, nil
+}
+
+// activateSigningCertificate 将 thumbprint 对应的证书设为服务主体的当前签名证书
+func (s *EntraService) activateSigningCertificate(ctx context.Context, spID, thumbprint string) error {
+	updateSp := models.NewServicePrincipal()
+	updateSp.SetPreferredTokenSigningKeyThumbprint(pointer(thumbprint))
+	if _, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Patch(ctx, updateSp, nil); err != nil {
+		return fmt.Errorf("activate tokenSigningCertificate failed: %w", err)
+	}
+	log.Printf("✅ tokenSigningCertificate activated: %s\n", thumbprint)
+	return nil
+}
+
+// signingCertificateName 展开 {unique_id}, Graph 要求名称以 CN= 开头
+func signingCertificateName(pattern string, idpConfig *IdpConfig) string {
+	name := strings.ReplaceAll(pattern, "{unique_id}", idpConfig.UniqueID)
+	if !strings.HasPrefix(name, "CN=") {
+		name = "CN=" + name
+	}
+	return name
+}
+
+// listSigningCertificates 列出服务主体的签名证书, 按过期时间排序
+func (s *EntraService) listSigningCertificates(ctx context.Context, spID string) ([]SigningCertificate, error) {
+	sp, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Get(ctx, &serviceprincipals.ServicePrincipalItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &serviceprincipals.ServicePrincipalItemRequestBuilderGetQueryParameters{
+			Select: []string{"id", "keyCredentials", "preferredTokenSigningKeyThumbprint"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	activeThumbprint := strings.ToUpper(stringValue(sp.GetPreferredTokenSigningKeyThumbprint()))
+
+	var certs []SigningCertificate
+	for _, key := range sp.GetKeyCredentials() {
+		// each signing certificate has a Sign and a Verify key sharing the thumbprint
+		if stringValue(key.GetUsage()) != "Verify" || key.GetKeyId() == nil {
+			continue
+		}
+		cert := SigningCertificate{
+			KeyID:       key.GetKeyId().String(),
+			Thumbprint:  strings.ToUpper(hex.EncodeToString(key.GetCustomKeyIdentifier())),
+			DisplayName: stringValue(key.GetDisplayName()),
+		}
+		if key.GetStartDateTime() != nil {
+			cert.StartDateTime = *key.GetStartDateTime()
+		}
+		if key.GetEndDateTime() != nil {
+			cert.EndDateTime = *key.GetEndDateTime()
+		}
+		cert.Active = cert.Thumbprint == activeThumbprint
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].EndDateTime.Before(certs[j].EndDateTime) })
+	return certs, nil
+}
+
+// ListSigningCertificates 列出租户已接入应用的签名证书
+func (s *EntraService) ListSigningCertificates(ctx context.Context, tenantID string) ([]SigningCertificate, error) {
+	record, err := s.workflows.load(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if record.ServicePrincipalID == "" {
+		return nil, errors.New("tenant has no service principal")
+	}
+	return s.listSigningCertificates(ctx, record.ServicePrincipalID)
+}
+
+// RotateSigningCertificate 在当前签名证书将要过期时 (force 时立即) 轮换签名证书:
+//  1. 添加新证书, 此时仍由旧证书签名;
+//  2. 将添加时返回的新证书直接推送给 UCS, UCS 此后同时信任新旧证书;
+//  3. 将新证书设为当前签名证书;
+//  4. 下载切换后由新证书签名的联合元数据, 校验后推送给 UCS.
+//
+// 应用的联合元数据只列出当前签名证书, 切换前无法从中得到新证书, 因此第 2 步不经过元数据.
+// 任一步骤失败时恢复之前的签名证书并删除新证书. 切换后旧证书保留在服务主体上直到过期, 但不再用于签名.
+func (s *EntraService) RotateSigningCertificate(ctx context.Context, tenantID string, force bool) (*SigningCertificate, bool, error) {
+	record, err := s.workflows.load(ctx, tenantID)
+	if err != nil {
+		return nil, false, err
+	}
+	if record.ServicePrincipalID == "" || record.Idp == nil {
+		return nil, false, errors.New("tenant has no saml application")
+	}
+
+	certs, err := s.listSigningCertificates(ctx, record.ServicePrincipalID)
+	if err != nil {
+		return nil, false, fmt.Errorf("list signing certificates failed: %w", err)
+	}
+	var previous *SigningCertificate
+	for i := range certs {
+		if certs[i].Active {
+			previous = &certs[i]
+		}
+	}
+	if previous != nil && !force && !previous.ExpiresWithin(s.cfg.SigningCertificate.RotateWithin()) {
+		log.Printf("🔏 signing certificate %s valid until %s, no rotation needed", previous.Thumbprint, previous.EndDateTime.Format(time.RFC3339))
+		return previous, false, nil
+	}
+
+	log.Printf("🔄 rotate signing certificate of tenant %s", tenantID)
+	cert, err := s.addSigningCertificate(ctx, record.ServicePrincipalID, record.Idp)
+	if err != nil {
+		return nil, false, fmt.Errorf("add signing certificate failed: %w", err)
+	}
+	if previous != nil {
+		if err := s.trustSigningCertificate(ctx, record, previous, cert); err != nil {
+			s.abortRotation(ctx, record.ServicePrincipalID, previous, cert)
+			return nil, false, err
+		}
+	}
+	if err := s.activateSigningCertificate(ctx, record.ServicePrincipalID, cert.Thumbprint); err != nil {
+		s.abortRotation(ctx, record.ServicePrincipalID, previous, cert)
+		return nil, false, err
+	}
+	if err := s.publishSigningCertificate(ctx, record, cert); err != nil {
+		s.abortRotation(ctx, record.ServicePrincipalID, previous, cert)
+		return nil, false, err
+	}
+	cert.Active = true
+
+	record.CertKeyID = cert.KeyID
+	if err := s.workflows.save(ctx, record); err != nil {
+		log.Printf("⚠️  save workflow record failed: %v", err)
+	}
+	return cert, true, nil
+}
+
+// rotationFormData 是轮换时推送给 UCS 的表单, scim token 保持不变
+func rotationFormData(record *WorkflowRecord) map[string]string {
+	return map[string]string{
+		"system_key": "office365",
+		"unique_id":  record.Idp.UniqueID,
+		"entity_id":  record.EntityID,
+	}
+}
+
+// trustSigningCertificate 在切换前将新证书推送给 UCS: 随当前 (仍由之前的证书签名) 的联合元数据上传,
+// 新证书放在 signing_certificate 字段
+func (s *EntraService) trustSigningCertificate(ctx context.Context, record *WorkflowRecord, previous, cert *SigningCertificate) error {
+	certificate, err := x509.ParseCertificate(cert.der)
+	if err != nil {
+		return fmt.Errorf("parse signing certificate %s: %w", cert.Thumbprint, err)
+	}
+	if thumbprint := metadata.Thumbprint(certificate); thumbprint != cert.Thumbprint {
+		return fmt.Errorf("signing certificate thumbprint %s, want %s", thumbprint, cert.Thumbprint)
+	}
+
+	data, err := s.downloadFederationMetadata(ctx, record.TenantID, record.AppClientID)
+	if err != nil {
+		return fmt.Errorf("download federation metadata failed: %w", err)
+	}
+	if err := s.verifyFederationMetadata(data, record.TenantID, previous.Thumbprint, previous.Thumbprint); err != nil {
+		return err
+	}
+	formData := rotationFormData(record)
+	formData["signing_certificate"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+	if err := s.updateIdpMetadata(ctx, data, formData); err != nil {
+		return fmt.Errorf("push signing certificate failed: %w", err)
+	}
+	log.Printf("✅ signing certificate %s pushed to ucs before activation", cert.Thumbprint)
+	return nil
+}
+
+// publishSigningCertificate 等待切换后的联合元数据由新证书签名, 校验通过后推送给 UCS
+func (s *EntraService) publishSigningCertificate(ctx context.Context, record *WorkflowRecord, cert *SigningCertificate) error {
+	var data []byte
+	applicationTimeout, _ := s.cfg.Polling.Timeouts()
+	err := s.poller(applicationTimeout).Wait(ctx, poll.Probe{Name: "联合元数据由新签名证书签名", Check: func(ctx context.Context) (bool, error) {
+		downloaded, err := s.downloadFederationMetadata(ctx, record.TenantID, record.AppClientID)
+		if err != nil {
+			return false, err
+		}
+		err = s.verifyFederationMetadata(downloaded, record.TenantID, cert.Thumbprint, cert.Thumbprint)
+		if errors.Is(err, metadata.ErrCertificateMismatch) {
+			// the switch has not propagated yet
+			return false, err
+		}
+		if err != nil {
+			return false, poll.Permanent(err)
+		}
+		data = downloaded
+		return true, nil
+	}})
+	if err != nil {
+		return fmt.Errorf("federation metadata is not signed by certificate %s: %w", cert.Thumbprint, err)
+	}
+	s.storeFederationMetadata(ctx, record.TenantID, record.AppClientID, data)
+
+	if err := s.updateIdpMetadata(ctx, data, rotationFormData(record)); err != nil {
+		return fmt.Errorf("push federation metadata failed: %w", err)
+	}
+	log.Printf("✅ federation metadata signed by %s pushed to ucs", cert.Thumbprint)
+	return nil
+}
+
+// abortRotation 恢复之前的签名证书并删除新添加的证书, 失败只记录日志
+func (s *EntraService) abortRotation(ctx context.Context, spID string, previous, added *SigningCertificate) {
+	if previous != nil {
+		if err := s.activateSigningCertificate(ctx, spID, previous.Thumbprint); err != nil {
+			log.Printf("❌ restore signing certificate %s failed: %v", previous.Thumbprint, err)
+		}
+	}
+	if err := s.removeTokenSigningCertificate(ctx, spID, added.KeyID); err != nil {
+		log.Printf("❌ remove signing certificate %s failed: %v", added.Thumbprint, err)
+	}
+	log.Printf("↩️  signing certificate rotation aborted, %s removed", added.Thumbprint)
+}
+
+// StartCertificateRotation 按 check_interval 定期检查所有已接入的租户, 轮换将要过期的签名证书.
+// 多副本部署时只应在一个副本上启用
+func (s *EntraService) StartCertificateRotation(ctx context.Context) {
+	interval := s.cfg.SigningCertificate.CheckEvery()
+	if interval <= 0 {
+		return
+	}
+	log.Printf("🔏 signing certificate rotation check every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.rotateDueCertificates(ctx)
+			}
+		}
+	}()
+}
+
+// rotateDueCertificates 轮换所有租户将要过期的签名证书, token 通过接入时登录的账号静默获取
+func (s *EntraService) rotateDueCertificates(ctx context.Context) {
+	tenants, err := s.workflows.tenants(ctx)
+	if err != nil {
+		log.Printf("❌ list onboarded tenants failed: %v", err)
+		return
+	}
+	for _, tenantID := range tenants {
+		record, err := s.workflows.load(ctx, tenantID)
+		if err != nil {
+			log.Printf("❌ load workflow record of tenant %s failed: %v", tenantID, err)
+			continue
+		}
+		if record.ServicePrincipalID == "" || record.Idp == nil {
+			continue
+		}
+		graphClient, err := s.graphClientForTenant(record)
+		if err != nil {
+			log.Printf("❌ signing certificate check of tenant %s skipped: %v", tenantID, err)
+			continue
+		}
+		if _, _, err := s.withGraphClient(graphClient).RotateSigningCertificate(ctx, tenantID, false); err != nil {
+			log.Printf("❌ rotate signing certificate of tenant %s failed: %v", tenantID, err)
+		}
+	}
+}
+
+// request from ucs
+// [GET] /tenant/certificates?tenant_id= 签名证书及推送过的联合元数据版本
+// [GET] /tenant/certificates?tenant_id=&digest= 推送过的联合元数据, digest 为 latest 时返回最新版本
+// [POST] /tenant/certificates?tenant_id=&force=true 轮换将要过期的签名证书
+// Authorization: Bearer <ucs api key>
+func (s *EntraService) HandleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeUCS(w, r) {
+		return
+	}
+	tenantID := r.URL.Query().Get("tenant_id")
+	if tenantID == "" {
+		http.Error(w, "tenant_id missing", http.StatusBadRequest)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	ctx := r.Context()
+	exists, err := s.workflows.exists(ctx, tenantID)
+	if err != nil {
+		http.Error(w, "load workflow record failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "tenant not onboarded", http.StatusNotFound)
+		return
+	}
+	record, err := s.workflows.load(ctx, tenantID)
+	if err != nil {
+		http.Error(w, "load workflow record failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if digest := r.URL.Query().Get("digest"); r.Method == http.MethodGet && digest != "" {
+		s.writeStoredMetadata(w, r, record, digest)
+		return
+	}
+	graphClient, err := s.graphClientForTenant(record)
+	if err != nil {
+		http.Error(w, "Failed to NewGraphServiceClient: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	service := s.withGraphClient(graphClient)
+
+	if r.Method == http.MethodGet {
+		certs, err := service.ListSigningCertificates(ctx, tenantID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, classifyOnboardingError(err))
+			return
+		}
+		var history []metadata.Revision
+		if record.AppClientID != "" {
+			history, err = s.metadataStore.History(ctx, tenantID, record.AppClientID)
+			if err != nil {
+				http.Error(w, "load federation metadata history failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"tenant_id": tenantID, "certificates": certs, "metadata": history})
+		return
+	}
+
+	cert, rotated, err := service.RotateSigningCertificate(ctx, tenantID, force)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, classifyOnboardingError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tenant_id": tenantID, "rotated": rotated, "certificate": cert})
+}
+
+// writeStoredMetadata 返回元数据仓库中该租户应用的联合元数据
+func (s *EntraService) writeStoredMetadata(w http.ResponseWriter, r *http.Request, record *WorkflowRecord, digest string) {
+	if record.AppClientID == "" {
+		http.Error(w, "tenant has no saml application", http.StatusNotFound)
+		return
+	}
+	var data []byte
+	var err error
+	if digest == "latest" {
+		var rev metadata.Revision
+		rev, data, err = s.metadataStore.Latest(r.Context(), record.TenantID, record.AppClientID)
+		digest = rev.Digest
+	} else {
+		data, err = s.metadataStore.Get(r.Context(), record.TenantID, record.AppClientID, digest)
+	}
+	if errors.Is(err, metadata.ErrNotFound) {
+		http.Error(w, "federation metadata not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "load federation metadata failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.Write(data)
+}
+
+// validateFederationMetadata 校验下载的联合元数据: 签名、有效期、颁发者为该租户,
+// 且包含应用当前的签名证书 (即不是其他应用的元数据)
+func (s *EntraService) validateFederationMetadata(ctx context.Context, data []byte, spID, tenantID string) error {
+	certs, err := s.listSigningCertificates(ctx, spID)
+	if err != nil {
+		return fmt.Errorf("list signing certificates failed: %w", err)
+	}
+	var active string
+	for _, cert := range certs {
+		if cert.Active {
+			active = cert.Thumbprint
+		}
+	}
+	return s.verifyFederationMetadata(data, tenantID, active, active)
+}
+
+// verifyFederationMetadata 校验联合元数据由 signer 证书签名、颁发者为该租户且列出 thumbprint 证书,
+// signer 为空时信任元数据中的任一签名证书
+func (s *EntraService) verifyFederationMetadata(data []byte, tenantID, signer, thumbprint string) error {
+	md, err := metadata.Parse(data)
+	if err != nil {
+		return newOnboardingError(ErrInvalidMetadata, err)
+	}
+	expectations := metadata.Expectations{
+		EntityID:          s.cloud.Issuer(tenantID),
+		SigningThumbprint: thumbprint,
+		RequireSignature:  true,
+	}
+	if signer != thumbprint {
+		trusted := md.Certificate(signer)
+		if trusted == nil {
+			return newOnboardingError(ErrInvalidMetadata, fmt.Errorf("%w: signer %s not found", metadata.ErrCertificateMismatch, signer))
+		}
+		expectations.TrustedCerts = []*x509.Certificate{trusted}
+	}
+	if err := md.Validate(expectations); err != nil {
+		return newOnboardingError(ErrInvalidMetadata, err)
+	}
+	log.Printf("✅ federation metadata verified: entity id %s, %d signing certificates", md.EntityID, len(md.SigningCertificates))
+	return nil
+}
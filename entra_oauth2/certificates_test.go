@@ -0,0 +1,295 @@
+package entra_oauth2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/beevik/etree"
+	"github.com/go-resty/resty/v2"
+	dsig "github.com/russellhaering/goxmldsig"
+	"idp-test-go/config"
+	"idp-test-go/metadata"
+	"idp-test-go/store"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCache is a CacheStore without encryption
+type memoryCache map[string][]byte
+
+func (c memoryCache) SaveCache(ctx context.Context, key string, data []byte) error {
+	c[key] = data
+	return nil
+}
+
+func (c memoryCache) LoadCache(ctx context.Context, key string) ([]byte, error) {
+	data, exist := c[key]
+	if !exist {
+		return nil, store.ErrNotFound
+	}
+	return data, nil
+}
+
+func (c memoryCache) DeleteCache(ctx context.Context, key string) error {
+	delete(c, key)
+	return nil
+}
+
+// signingKey is a signing certificate of the stubbed service principal
+type signingKey struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func (k signingKey) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return k.key, k.cert.Raw, nil
+}
+
+func newSigningKey(t *testing.T) signingKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{key: key, cert: selfSigned(t, key)}
+}
+
+// signedMetadata returns federation metadata listing only the key and signed by it, as Entra
+// publishes the active signing certificate of an application
+func signedMetadata(t *testing.T, tenantID string, key signingKey) []byte {
+	t.Helper()
+	doc := etree.NewDocument()
+	err := doc.ReadFromString(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" ID="_metadata" entityID="https://sts.example/` + tenantID + `/">` +
+		`<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>` +
+		base64.StdEncoding.EncodeToString(key.cert.Raw) +
+		`</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+		`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://login.example/saml2"/>` +
+		`</IDPSSODescriptor></EntityDescriptor>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := dsig.NewDefaultSigningContext(key).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.SetRoot(signed)
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// rotationStub serves the service principal, its federation metadata and the ucs metadata
+// endpoint, and records the calls that matter for the rotation order
+type rotationStub struct {
+	t        *testing.T
+	previous signingKey
+	added    signingKey
+
+	// fail the ucs push with this index (1-based), 0 to accept every push
+	failPush int
+
+	mu     sync.Mutex
+	active signingKey
+	keys   []signingKey
+	pushes int
+	events []string
+}
+
+func (st *rotationStub) record(format string, args ...any) {
+	st.events = append(st.events, fmt.Sprintf(format, args...))
+}
+
+func (st *rotationStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1.0/servicePrincipals/sp":
+		var keys []map[string]any
+		for i, key := range st.keys {
+			thumbprint, _ := hex.DecodeString(metadata.Thumbprint(key.cert))
+			keys = append(keys, map[string]any{
+				"keyId":               fmt.Sprintf("00000000-0000-0000-0000-00000000000%d", i+1),
+				"usage":               "Verify",
+				"type":                "AsymmetricX509Cert",
+				"customKeyIdentifier": base64.StdEncoding.EncodeToString(thumbprint),
+				"endDateTime":         key.cert.NotAfter.Format(time.RFC3339),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":                                 "sp",
+			"preferredTokenSigningKeyThumbprint": metadata.Thumbprint(st.active.cert),
+			"keyCredentials":                     keys,
+		})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1.0/servicePrincipals/sp/addTokenSigningCertificate":
+		st.record("add")
+		st.keys = append(st.keys, st.added)
+		json.NewEncoder(w).Encode(map[string]any{
+			"keyId":         fmt.Sprintf("00000000-0000-0000-0000-00000000000%d", len(st.keys)),
+			"thumbprint":    metadata.Thumbprint(st.added.cert),
+			"key":           base64.StdEncoding.EncodeToString(st.added.cert.Raw),
+			"displayName":   "CN=idp",
+			"startDateTime": st.added.cert.NotBefore.Format(time.RFC3339),
+			"endDateTime":   st.added.cert.NotAfter.Format(time.RFC3339),
+		})
+
+	case r.Method == http.MethodPatch && r.URL.Path == "/v1.0/servicePrincipals/sp":
+		var body struct {
+			PreferredTokenSigningKeyThumbprint string            `json:"preferredTokenSigningKeyThumbprint"`
+			KeyCredentials                     []json.RawMessage `json:"keyCredentials"`
+		}
+		reader := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			// the graph client compresses request bodies
+			reader, _ = gzip.NewReader(r.Body)
+		}
+		json.NewDecoder(reader).Decode(&body)
+		switch {
+		case body.PreferredTokenSigningKeyThumbprint == metadata.Thumbprint(st.added.cert):
+			st.record("activate added")
+			st.active = st.added
+		case body.PreferredTokenSigningKeyThumbprint == metadata.Thumbprint(st.previous.cert):
+			st.record("activate previous")
+			st.active = st.previous
+		case body.KeyCredentials != nil:
+			st.record("remove %d keys", len(st.keys)-len(body.KeyCredentials))
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && r.URL.Path == "/tenant/federationmetadata/2007-06/federationmetadata.xml":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(signedMetadata(st.t, "tenant", st.active))
+
+	case r.Method == http.MethodPut && r.URL.Path == "/proxy/directory/idp/identity_provider/metadata":
+		st.pushes++
+		file, _, err := r.FormFile("metadata")
+		if err != nil {
+			st.t.Errorf("metadata file: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		md, err := metadata.Parse(data)
+		if err != nil {
+			st.t.Errorf("pushed metadata: %v", err)
+			return
+		}
+		event := "push metadata " + st.name(md.SigningCertificates[0])
+		if block, _ := pem.Decode([]byte(r.FormValue("signing_certificate"))); block != nil {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				st.t.Errorf("pushed signing certificate: %v", err)
+				return
+			}
+			event += " with certificate " + st.name(cert)
+		}
+		st.record(event)
+		if st.pushes == st.failPush {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		st.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (st *rotationStub) name(cert *x509.Certificate) string {
+	switch {
+	case cert.Equal(st.previous.cert):
+		return "previous"
+	case cert.Equal(st.added.cert):
+		return "added"
+	}
+	return "unknown"
+}
+
+func TestRotateSigningCertificate(t *testing.T) {
+	tests := []struct {
+		name       string
+		failPush   int
+		wantEvents []string
+		wantErr    bool
+	}{
+		{name: "rotated", wantEvents: []string{
+			"add",
+			"push metadata previous with certificate added",
+			"activate added",
+			"push metadata added",
+		}},
+		{name: "ucs rejects the new certificate", failPush: 1, wantErr: true, wantEvents: []string{
+			"add",
+			"push metadata previous with certificate added",
+			"activate previous",
+			"remove 1 keys",
+		}},
+		{name: "ucs rejects the switched metadata", failPush: 2, wantErr: true, wantEvents: []string{
+			"add",
+			"push metadata previous with certificate added",
+			"activate added",
+			"push metadata added",
+			"activate previous",
+			"remove 1 keys",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := newSigningKey(t)
+			stub := &rotationStub{t: t, previous: previous, added: newSigningKey(t), failPush: tt.failPush,
+				active: previous, keys: []signingKey{previous}}
+			s, server := stubGraphService(t, stub)
+			s.cloud = CloudEnvironment{GraphEndpoint: server.URL, MetadataHost: server.URL, SAMLIssuer: "https://sts.example/%s/"}
+			s.ucsBaseURL = server.URL
+			s.httpClient = resty.New()
+			s.metadataStore = metadata.NewMemoryStore()
+			s.workflows = &workflowStore{backend: store.NewMemoryBackend(), sealed: memoryCache{}}
+			s.cfg.Polling = config.PollingConfig{InitialInterval: "5ms", MaxInterval: "10ms", ApplicationTimeout: "1s"}
+
+			ctx := context.Background()
+			record := newWorkflowRecord("tenant")
+			record.ServicePrincipalID = "sp"
+			record.AppClientID = "client"
+			record.Idp = &IdpConfig{UniqueID: "idp"}
+			if err := s.workflows.save(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+
+			cert, rotated, err := s.RotateSigningCertificate(ctx, "tenant", true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RotateSigningCertificate error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(stub.events, tt.wantEvents) {
+				t.Errorf("events:\n  %s\nwant:\n  %s", strings.Join(stub.events, "\n  "), strings.Join(tt.wantEvents, "\n  "))
+			}
+			if tt.wantErr {
+				if !stub.active.cert.Equal(previous.cert) {
+					t.Error("previous signing certificate not restored")
+				}
+				return
+			}
+			if !rotated || !cert.Active || cert.Thumbprint != metadata.Thumbprint(stub.added.cert) {
+				t.Errorf("RotateSigningCertificate = %+v, %v; want the added certificate, rotated", cert, rotated)
+			}
+			if _, _, err := s.metadataStore.Latest(ctx, "tenant", "client"); err != nil {
+				t.Errorf("switched metadata not stored: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package entra_oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/policies"
+	"log"
+	"os"
+	"slices"
+)
+
+const samlNameIDClaimType = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/nameidentifier"
+
+// saml name id formats by short name
+var samlNameIDFormats = map[string]string{
+	"unspecified":  "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+	"emailAddress": "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress",
+	"persistent":   "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
+	"transient":    "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+}
+
+// ClaimsSpec 声明 SAML 令牌中的 NameID、属性和组声明, 以声明映射策略应用到服务主体
+type ClaimsSpec struct {
+	NameID NameIDClaim `json:"name_id"`
+
+	// extra attribute statements
+	Attributes []AttributeClaim `json:"attributes"`
+
+	// groups claim: "", None, SecurityGroup, ApplicationGroup, DirectoryRole or All
+	Groups string `json:"groups"`
+
+	// claims transformations referenced by the name id or attributes
+	Transformations []ClaimsTransformation `json:"transformations"`
+
+	// keep the claims entra issues by default in addition to the mapped ones
+	IncludeBasicClaimSet bool `json:"include_basic_claim_set"`
+}
+
+type NameIDClaim struct {
+	// user attribute id, e.g. userprincipalname, mail, objectid
+	Attribute string `json:"attribute"`
+
+	// transformation id, replaces Attribute
+	Transformation string `json:"transformation,omitempty"`
+
+	// unspecified, emailAddress, persistent or transient
+	Format string `json:"format"`
+}
+
+type AttributeClaim struct {
+	// saml attribute name
+	Name string `json:"name"`
+
+	// user attribute id, e.g. givenname, surname, mail, department
+	Attribute string `json:"attribute,omitempty"`
+
+	// transformation id, replaces Attribute
+	Transformation string `json:"transformation,omitempty"`
+}
+
+type ClaimsTransformation struct {
+	ID string `json:"id"`
+
+	// transformation method, e.g. Join, ExtractMailPrefix, ToLowercase
+	Method string `json:"method"`
+
+	// input claims, transformation claim type => user attribute id
+	Inputs map[string]string `json:"inputs"`
+
+	// input parameters, id => value
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	// transformation claim type of the output, outputClaim by default
+	Output string `json:"output,omitempty"`
+}
+
+// LoadClaimsSpec 读取 JSON 格式的声明文件, 路径为空时返回 nil, SAML 步骤不修改应用的声明
+func LoadClaimsSpec(path string) (*ClaimsSpec, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read claims file: %w", err)
+	}
+	spec := &ClaimsSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("parse claims file %s: %w", path, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("claims file %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Validate 检查 NameID 格式、组声明取值和转换引用
+func (spec *ClaimsSpec) Validate() error {
+	if _, ok := samlNameIDFormats[spec.NameID.Format]; !ok && spec.NameID.Format != "" {
+		return fmt.Errorf("unknown name id format %q", spec.NameID.Format)
+	}
+	switch spec.Groups {
+	case "", "None", "SecurityGroup", "ApplicationGroup", "DirectoryRole", "All":
+	default:
+		return fmt.Errorf("unknown groups claim %q", spec.Groups)
+	}
+	transformations := make(map[string]bool)
+	for _, t := range spec.Transformations {
+		if t.ID == "" || t.Method == "" {
+			return fmt.Errorf("transformation needs an id and a method")
+		}
+		transformations[t.ID] = true
+	}
+	refs := []string{spec.NameID.Transformation}
+	for _, attr := range spec.Attributes {
+		if attr.Name == "" || attr.Attribute == "" && attr.Transformation == "" {
+			return fmt.Errorf("attribute claim needs a name and an attribute or transformation")
+		}
+		refs = append(refs, attr.Transformation)
+	}
+	for _, ref := range refs {
+		if ref != "" && !transformations[ref] {
+			return fmt.Errorf("unknown transformation %q", ref)
+		}
+	}
+	return nil
+}
+
+// definition 生成声明映射策略的定义
+func (spec *ClaimsSpec) definition() (string, error) {
+	type claimSchema struct {
+		Source           string `json:"Source"`
+		ID               string `json:"ID"`
+		TransformationID string `json:"TransformationId,omitempty"`
+		SamlClaimType    string `json:"SamlClaimType"`
+		SamlNameIDFormat string `json:"SamlNameIdFormat,omitempty"`
+	}
+	claim := func(samlType, attribute, transformation string) claimSchema {
+		if transformation != "" {
+			return claimSchema{Source: "transformation", ID: transformation, TransformationID: transformation, SamlClaimType: samlType}
+		}
+		return claimSchema{Source: "user", ID: attribute, SamlClaimType: samlType}
+	}
+
+	var schema []claimSchema
+	if spec.NameID.Attribute != "" || spec.NameID.Transformation != "" {
+		nameID := claim(samlNameIDClaimType, spec.NameID.Attribute, spec.NameID.Transformation)
+		nameID.SamlNameIDFormat = samlNameIDFormats[spec.NameID.Format]
+		schema = append(schema, nameID)
+	}
+	for _, attr := range spec.Attributes {
+		schema = append(schema, claim(attr.Name, attr.Attribute, attr.Transformation))
+	}
+
+	type claimRef struct {
+		ClaimTypeReferenceID    string `json:"ClaimTypeReferenceId"`
+		TransformationClaimType string `json:"TransformationClaimType"`
+	}
+	type parameter struct {
+		ID    string `json:"ID"`
+		Value string `json:"Value"`
+	}
+	type transformation struct {
+		ID                   string      `json:"ID"`
+		TransformationMethod string      `json:"TransformationMethod"`
+		InputClaims          []claimRef  `json:"InputClaims,omitempty"`
+		InputParameters      []parameter `json:"InputParameters,omitempty"`
+		OutputClaims         []claimRef  `json:"OutputClaims"`
+	}
+	var transformations []transformation
+	for _, t := range spec.Transformations {
+		out := transformation{ID: t.ID, TransformationMethod: t.Method}
+		for _, claimType := range sortedKeys(t.Inputs) {
+			out.InputClaims = append(out.InputClaims, claimRef{ClaimTypeReferenceID: t.Inputs[claimType], TransformationClaimType: claimType})
+		}
+		for _, id := range sortedKeys(t.Parameters) {
+			out.InputParameters = append(out.InputParameters, parameter{ID: id, Value: t.Parameters[id]})
+		}
+		output := t.Output
+		if output == "" {
+			output = "outputClaim"
+		}
+		out.OutputClaims = []claimRef{{ClaimTypeReferenceID: t.ID, TransformationClaimType: output}}
+		transformations = append(transformations, out)
+	}
+
+	policy := map[string]any{
+		"Version":              1,
+		"IncludeBasicClaimSet": fmt.Sprint(spec.IncludeBasicClaimSet),
+		"ClaimsSchema":         schema,
+	}
+	if len(transformations) > 0 {
+		policy["ClaimsTransformations"] = transformations
+	}
+	definition, err := json.Marshal(map[string]any{"ClaimsMappingPolicy": policy})
+	return string(definition), err
+}
+
+func claimsPolicyName(idpConfig *IdpConfig) string {
+	return "ucs-idp-claims-" + idpConfig.UniqueID
+}
+
+// configureClaims 创建或更新该 idp 的声明映射策略, 分配给服务主体并设置组声明
+func (s *EntraService) configureClaims(ctx context.Context, app models.Applicationable, sp models.ServicePrincipalable, spec *ClaimsSpec, idpConfig *IdpConfig, record *WorkflowRecord) error {
+	definition, err := spec.definition()
+	if err != nil {
+		return err
+	}
+
+	// 策略: 按记录或名称复用, 定义变化时更新
+	policyID := record.ClaimsPolicyID
+	if policyID == "" {
+		policyID, err = s.findClaimsPolicy(ctx, claimsPolicyName(idpConfig))
+		if err != nil {
+			return fmt.Errorf("find claims mapping policy failed: %w", err)
+		}
+	}
+	policy := models.NewClaimsMappingPolicy()
+	policy.SetDisplayName(pointer(claimsPolicyName(idpConfig)))
+	policy.SetDefinition([]string{definition})
+	if policyID == "" {
+		created, err := s.graphClient.Policies().ClaimsMappingPolicies().Post(ctx, policy, nil)
+		if err != nil {
+			return fmt.Errorf("create claims mapping policy failed: %w", err)
+		}
+		policyID = *created.GetId()
+		log.Printf("✅ claims mapping policy created: %s", policyID)
+	} else {
+		if _, err := s.graphClient.Policies().ClaimsMappingPolicies().ByClaimsMappingPolicyId(policyID).Patch(ctx, policy, nil); err != nil {
+			return fmt.Errorf("update claims mapping policy failed: %w", err)
+		}
+		log.Printf("♻️  claims mapping policy updated: %s", policyID)
+	}
+	record.ClaimsPolicyID = policyID
+
+	// 分配: 服务主体只能有一个声明映射策略, 先移除其他策略
+	spID := *sp.GetId()
+	assigned, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).ClaimsMappingPolicies().Get(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("list assigned claims mapping policies failed: %w", err)
+	}
+	alreadyAssigned := false
+	for _, p := range assigned.GetValue() {
+		if id := stringValue(p.GetId()); id == policyID {
+			alreadyAssigned = true
+		} else if err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).ClaimsMappingPolicies().ByClaimsMappingPolicyId(id).Ref().Delete(ctx, nil); err != nil {
+			return fmt.Errorf("unassign claims mapping policy %s failed: %w", id, err)
+		}
+	}
+	if !alreadyAssigned {
+		ref := models.NewReferenceCreate()
+		ref.SetOdataId(pointer(s.cloud.GraphURL("/policies/claimsMappingPolicies/" + policyID)))
+		if err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).ClaimsMappingPolicies().Ref().Post(ctx, ref, nil); err != nil {
+			return fmt.Errorf("assign claims mapping policy failed: %w", err)
+		}
+	}
+	log.Printf("✅ claims mapping policy assigned to service principal %s", spID)
+
+	// 组声明
+	if spec.Groups != "" {
+		updateApp := models.NewApplication()
+		updateApp.SetGroupMembershipClaims(pointer(spec.Groups))
+		if _, err := s.graphClient.Applications().ByApplicationId(*app.GetId()).Patch(ctx, updateApp, nil); err != nil {
+			return fmt.Errorf("update group membership claims failed: %w", err)
+		}
+		log.Printf("✅ group membership claims: %s", spec.Groups)
+	}
+	return nil
+}
+
+func (s *EntraService) findClaimsPolicy(ctx context.Context, displayName string) (string, error) {
+	result, err := s.graphClient.Policies().ClaimsMappingPolicies().Get(ctx, &policies.ClaimsMappingPoliciesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &policies.ClaimsMappingPoliciesRequestBuilderGetQueryParameters{
+			Filter: pointer(fmt.Sprintf("displayName eq '%s'", odataString(displayName))),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if values := result.GetValue(); len(values) > 0 {
+		return stringValue(values[0].GetId()), nil
+	}
+	return "", nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
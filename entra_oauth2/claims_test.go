@@ -0,0 +1,93 @@
+package entra_oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestClaimsSpecValidate(t *testing.T) {
+	mailPrefix := ClaimsTransformation{ID: "MailPrefix", Method: "ExtractMailPrefix", Inputs: map[string]string{"mail": "userprincipalname"}}
+	tests := []struct {
+		name    string
+		spec    ClaimsSpec
+		wantErr string
+	}{
+		{name: "empty", spec: ClaimsSpec{}},
+		{name: "name id and attributes", spec: ClaimsSpec{
+			NameID:     NameIDClaim{Attribute: "userprincipalname", Format: "persistent"},
+			Attributes: []AttributeClaim{{Name: "mail", Attribute: "mail"}},
+			Groups:     "SecurityGroup",
+		}},
+		{name: "transformation references", spec: ClaimsSpec{
+			NameID:          NameIDClaim{Transformation: "MailPrefix", Format: "unspecified"},
+			Attributes:      []AttributeClaim{{Name: "username", Transformation: "MailPrefix"}},
+			Transformations: []ClaimsTransformation{mailPrefix},
+		}},
+		{name: "unknown name id format", spec: ClaimsSpec{NameID: NameIDClaim{Attribute: "mail", Format: "email"}},
+			wantErr: `unknown name id format "email"`},
+		{name: "unknown groups claim", spec: ClaimsSpec{Groups: "securitygroup"},
+			wantErr: `unknown groups claim "securitygroup"`},
+		{name: "transformation without method", spec: ClaimsSpec{Transformations: []ClaimsTransformation{{ID: "MailPrefix"}}},
+			wantErr: "transformation needs an id and a method"},
+		{name: "attribute without name", spec: ClaimsSpec{Attributes: []AttributeClaim{{Attribute: "mail"}}},
+			wantErr: "attribute claim needs a name"},
+		{name: "attribute without source", spec: ClaimsSpec{Attributes: []AttributeClaim{{Name: "mail"}}},
+			wantErr: "attribute claim needs a name and an attribute or transformation"},
+		{name: "name id unknown transformation", spec: ClaimsSpec{NameID: NameIDClaim{Transformation: "MailPrefix"}},
+			wantErr: `unknown transformation "MailPrefix"`},
+		{name: "attribute unknown transformation", spec: ClaimsSpec{
+			Attributes:      []AttributeClaim{{Name: "username", Transformation: "Lower"}},
+			Transformations: []ClaimsTransformation{mailPrefix},
+		}, wantErr: `unknown transformation "Lower"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClaimsSpecDefinition(t *testing.T) {
+	spec, err := LoadClaimsSpec("../claims.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	definition, err := spec.definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := json.Indent(&got, []byte(definition), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteByte('\n')
+
+	const golden = "testdata/claims_policy.golden.json"
+	if *update {
+		if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("definition of claims.example.json differs from %s:\n%s", golden, got.String())
+	}
+}
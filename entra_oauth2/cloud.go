@@ -0,0 +1,130 @@
+package entra_oauth2
+
+import (
+	"fmt"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"idp-test-go/config"
+	"net/url"
+)
+
+// CloudEnvironment 国家云的 Entra 登录、Graph 和联合元数据终结点
+type CloudEnvironment struct {
+	Name string `json:"name"`
+
+	// MSAL authority 和 OAuth2 终结点所在主机, e.g. https://login.microsoftonline.com
+	AuthorityHost string `json:"authority_host"`
+
+	// Graph 根地址, 不含版本, e.g. https://graph.microsoft.com
+	GraphEndpoint string `json:"graph_endpoint"`
+
+	// 联合元数据所在主机
+	MetadataHost string `json:"metadata_host"`
+
+	// SAML token 和联合元数据中的颁发者, %s 为租户 ID
+	SAMLIssuer string `json:"saml_issuer"`
+}
+
+var cloudEnvironments = map[string]CloudEnvironment{
+	config.CloudGlobal: {
+		Name:          config.CloudGlobal,
+		AuthorityHost: "https://login.microsoftonline.com",
+		GraphEndpoint: "https://graph.microsoft.com",
+		MetadataHost:  "https://login.microsoftonline.com",
+		SAMLIssuer:    "https://sts.windows.net/%s/",
+	},
+	// GCC High
+	config.CloudUSGov: {
+		Name:          config.CloudUSGov,
+		AuthorityHost: "https://login.microsoftonline.us",
+		GraphEndpoint: "https://graph.microsoft.us",
+		MetadataHost:  "https://login.microsoftonline.us",
+		SAMLIssuer:    "https://login.microsoftonline.us/%s/",
+	},
+	// Azure China, operated by 21Vianet
+	config.CloudChina: {
+		Name:          config.CloudChina,
+		AuthorityHost: "https://login.partner.microsoftonline.cn",
+		GraphEndpoint: "https://microsoftgraph.chinacloudapi.cn",
+		MetadataHost:  "https://login.partner.microsoftonline.cn",
+		SAMLIssuer:    "https://sts.chinacloudapi.cn/%s/",
+	},
+}
+
+// LookupCloudEnvironment 返回 entra.cloud 配置对应的国家云
+func LookupCloudEnvironment(name string) (CloudEnvironment, error) {
+	cloud, exist := cloudEnvironments[name]
+	if !exist {
+		return CloudEnvironment{}, fmt.Errorf("unknown cloud environment %q", name)
+	}
+	return cloud, nil
+}
+
+// Authority 返回租户的 authority, 租户未知时 (登录前) 使用 common
+func (c CloudEnvironment) Authority(tenantID string) string {
+	if tenantID == "" {
+		tenantID = "common"
+	}
+	return c.AuthorityHost + "/" + tenantID
+}
+
+// GraphBaseURL 返回 Graph v1.0 根地址
+func (c CloudEnvironment) GraphBaseURL() string {
+	return c.GraphEndpoint + "/v1.0"
+}
+
+// GraphScope 返回 Graph 的 .default scope
+func (c CloudEnvironment) GraphScope() string {
+	return c.GraphEndpoint + "/.default"
+}
+
+// GraphPermission 返回该云 Graph 资源上的委托权限 scope, e.g. https://graph.microsoft.us/User.Read.
+// 不带资源前缀的权限总是指向全球 Graph
+func (c CloudEnvironment) GraphPermission(permission string) string {
+	return c.GraphEndpoint + "/" + permission
+}
+
+// GraphHost 返回 Graph 主机名, 只有发往该主机的请求才会附带 token
+func (c CloudEnvironment) GraphHost() string {
+	u, err := url.Parse(c.GraphEndpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// GraphURL 返回 Graph 对象的绝对地址, 用于 @odata.id 引用
+func (c CloudEnvironment) GraphURL(path string) string {
+	return c.GraphBaseURL() + path
+}
+
+// FederationMetadataURL 返回租户内应用的联合元数据地址
+func (c CloudEnvironment) FederationMetadataURL(tenantID, appClientID string) string {
+	return fmt.Sprintf("%s/%s/federationmetadata/2007-06/federationmetadata.xml?appid=%s", c.MetadataHost, tenantID, appClientID)
+}
+
+// Issuer 返回租户签发的 SAML token 的颁发者, 即联合元数据的 entityID
+func (c CloudEnvironment) Issuer(tenantID string) string {
+	return fmt.Sprintf(c.SAMLIssuer, tenantID)
+}
+
+func (s *EntraService) authURI() string {
+	if s.cfg.AuthURI != "" {
+		return s.cfg.AuthURI
+	}
+	return s.cloud.Authority("") + "/oauth2/v2.0/authorize"
+}
+
+func (s *EntraService) tokenURI() string {
+	if s.cfg.TokenURI != "" {
+		return s.cfg.TokenURI
+	}
+	return s.cloud.Authority("") + "/oauth2/v2.0/token"
+}
+
+// tenantIDOf 返回授权管理员所在的客户租户, 优先取 id token 的 tid
+func tenantIDOf(tokenResult *confidential.AuthResult) string {
+	if tokenResult.IDToken.TenantID != "" {
+		return tokenResult.IDToken.TenantID
+	}
+	return tokenResult.Account.Realm
+}
@@ -0,0 +1,137 @@
+package entra_oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"github.com/google/uuid"
+	"idp-test-go/config"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"time"
+)
+
+// clientCredential 构造 bootstrap app 的客户端凭据 (client secret 或证书签名的 client assertion)
+func (s *EntraService) clientCredential(ctx context.Context) (confidential.Credential, error) {
+	if s.cfg.AuthMethod == config.AuthMethodCertificate {
+		certs, key, err := s.loadCertificate(ctx)
+		if err != nil {
+			return confidential.Credential{}, err
+		}
+		return confidential.NewCredFromCert(certs, key)
+	}
+
+	clientSecret, err := s.secrets.GetSecret(ctx, s.cfg.ClientSecretName)
+	if err != nil {
+		return confidential.Credential{}, err
+	}
+	return confidential.NewCredFromSecret(clientSecret)
+}
+
+// clientAuthFormData 返回 token 请求中用于客户端认证的表单字段
+func (s *EntraService) clientAuthFormData(ctx context.Context, audience string) (map[string]string, error) {
+	if s.cfg.AuthMethod == config.AuthMethodCertificate {
+		assertion, err := s.clientAssertion(ctx, audience)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{
+			"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+			"client_assertion":      assertion,
+		}, nil
+	}
+
+	clientSecret, err := s.secrets.GetSecret(ctx, s.cfg.ClientSecretName)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"client_secret": clientSecret}, nil
+}
+
+// loadCertificate 从 PEM 或 PFX 文件加载证书链和私钥, 私钥必须是 RSA (client assertion 使用 RS256)
+func (s *EntraService) loadCertificate(ctx context.Context) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := os.ReadFile(s.cfg.CertificateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read certificate: %w", err)
+	}
+
+	password := ""
+	if s.cfg.CertificatePasswordName != "" {
+		password, err = s.secrets.GetSecret(ctx, s.cfg.CertificatePasswordName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.PrivateKey
+	switch strings.ToLower(filepath.Ext(s.cfg.CertificateFile)) {
+	case ".pfx", ".p12":
+		// 导出的 PFX 通常包含证书链, 叶子证书放在最前
+		var leaf *x509.Certificate
+		var chain []*x509.Certificate
+		key, leaf, chain, err = pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode pfx certificate: %w", err)
+		}
+		certs = append([]*x509.Certificate{leaf}, chain...)
+	default:
+		certs, key, err = confidential.CertFromPEM(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode pem certificate: %w", err)
+		}
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return nil, nil, fmt.Errorf("certificate %s: unsupported private key type %T, only RSA keys are supported", s.cfg.CertificateFile, key)
+	}
+	return certs, key, nil
+}
+
+// clientAssertion 生成用证书私钥签名的 client assertion (RFC 7523), 用于不经过 MSAL 的 token 请求
+func (s *EntraService) clientAssertion(ctx context.Context, audience string) (string, error) {
+	certs, key, err := s.loadCertificate(ctx)
+	if err != nil {
+		return "", err
+	}
+	rsaKey := key.(*rsa.PrivateKey)
+	thumbprint := sha1.Sum(certs[0].Raw)
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": s.cfg.ClientID,
+		"sub": s.cfg.ClientID,
+		"jti": uuid.New().String(),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,236 @@
+package entra_oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"idp-test-go/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mapSecrets serves secrets from a map
+type mapSecrets map[string]string
+
+func (m mapSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	secret, exist := m[name]
+	if !exist {
+		return "", fmt.Errorf("secret %s not found", name)
+	}
+	return secret, nil
+}
+
+// selfSigned returns a self-signed certificate for the key
+func selfSigned(t *testing.T, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bootstrap"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writePEM writes the certificate followed by its PKCS#8 key
+func writePEM(t *testing.T, path string, cert *x509.Certificate, key crypto.Signer) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certificateService(file, passwordName string, secrets mapSecrets) *EntraService {
+	return &EntraService{
+		cfg: config.EntraConfig{
+			ClientID:                "client-id",
+			AuthMethod:              config.AuthMethodCertificate,
+			CertificateFile:         file,
+			CertificatePasswordName: passwordName,
+		},
+		secrets: secrets,
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := selfSigned(t, rsaKey)
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := selfSigned(t, caKey)
+
+	pemFile := filepath.Join(dir, "client.pem")
+	writePEM(t, pemFile, leaf, rsaKey)
+
+	pfx, err := pkcs12.Modern.Encode(rsaKey, leaf, []*x509.Certificate{ca}, "pfx-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxFile := filepath.Join(dir, "client.pfx")
+	if err := os.WriteFile(pfxFile, pfx, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := filepath.Join(dir, "ec.pem")
+	writePEM(t, ecFile, selfSigned(t, ecKey), ecKey)
+
+	tests := []struct {
+		name      string
+		file      string
+		password  string
+		wantCerts int
+		wantErr   string
+	}{
+		{name: "pem", file: pemFile, wantCerts: 1},
+		{name: "pfx with chain", file: pfxFile, password: "pfx-password", wantCerts: 2},
+		{name: "pfx wrong password", file: pfxFile, password: "wrong", wantErr: "decode pfx certificate"},
+		{name: "non-rsa key", file: ecFile, wantErr: "only RSA keys are supported"},
+		{name: "missing file", file: filepath.Join(dir, "missing.pem"), wantErr: "read certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passwordName := ""
+			if tt.password != "" {
+				passwordName = "certificate-password"
+			}
+			s := certificateService(tt.file, passwordName, mapSecrets{"certificate-password": tt.password})
+			certs, key, err := s.loadCertificate(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadCertificate error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadCertificate: %v", err)
+			}
+			if len(certs) != tt.wantCerts {
+				t.Fatalf("got %d certificates, want %d", len(certs), tt.wantCerts)
+			}
+			if !certs[0].Equal(leaf) {
+				t.Error("leaf certificate is not first")
+			}
+			if !rsaKey.Equal(key) {
+				t.Error("private key does not match")
+			}
+		})
+	}
+}
+
+func TestClientAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := selfSigned(t, key)
+	file := filepath.Join(t.TempDir(), "client.pem")
+	writePEM(t, file, cert, key)
+
+	const audience = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	s := certificateService(file, "", nil)
+	assertion, err := s.clientAssertion(context.Background(), audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion has %d parts, want 3", len(parts))
+	}
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	thumbprint := sha1.Sum(cert.Raw)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("header = %v, want RS256 JWT", header)
+	}
+	if header["x5t"] != base64.RawURLEncoding.EncodeToString(thumbprint[:]) {
+		t.Errorf("x5t = %s, want the base64url sha1 thumbprint of the certificate", header["x5t"])
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Iss string `json:"iss"`
+		Sub string `json:"sub"`
+		Jti string `json:"jti"`
+		Nbf int64  `json:"nbf"`
+		Exp int64  `json:"exp"`
+	}
+	decodeSegment(t, parts[1], &claims)
+	if claims.Aud != audience || claims.Iss != "client-id" || claims.Sub != "client-id" {
+		t.Errorf("claims = %+v, want aud %s and iss/sub client-id", claims, audience)
+	}
+	if claims.Jti == "" {
+		t.Error("jti missing")
+	}
+	if now := time.Now().Unix(); claims.Nbf > now || claims.Exp <= now || claims.Exp-claims.Nbf != 600 {
+		t.Errorf("nbf %d, exp %d: want a ten minute window around now", claims.Nbf, claims.Exp)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+
+	again, err := s.clientAssertion(context.Background(), audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == assertion {
+		t.Error("two assertions are identical, jti is not unique")
+	}
+}
+
+func decodeSegment(t *testing.T, segment string, v any) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
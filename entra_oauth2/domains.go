@@ -0,0 +1,81 @@
+package entra_oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/microsoftgraph/msgraph-sdk-go/organization"
+	"net/url"
+	"strings"
+)
+
+// verifiedDomains 是租户已验证的域名
+type verifiedDomains struct {
+	names       []string
+	defaultName string
+	initialName string
+}
+
+// listVerifiedDomains 读取租户的已验证域名, 只需要 User.Read 权限
+func (s *EntraService) listVerifiedDomains(ctx context.Context) (*verifiedDomains, error) {
+	orgs, err := s.graphClient.Organization().Get(ctx, &organization.OrganizationRequestBuilderGetRequestConfiguration{
+		QueryParameters: &organization.OrganizationRequestBuilderGetQueryParameters{
+			Select: []string{"id", "verifiedDomains"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	domains := &verifiedDomains{}
+	for _, org := range orgs.GetValue() {
+		for _, domain := range org.GetVerifiedDomains() {
+			name := strings.ToLower(stringValue(domain.GetName()))
+			if name == "" {
+				continue
+			}
+			domains.names = append(domains.names, name)
+			if domain.GetIsDefault() != nil && *domain.GetIsDefault() {
+				domains.defaultName = name
+			}
+			if domain.GetIsInitial() != nil && *domain.GetIsInitial() {
+				domains.initialName = name
+			}
+		}
+	}
+	return domains, nil
+}
+
+// covers 判断 host 是否为已验证域名或其子域名
+func (d *verifiedDomains) covers(host string) bool {
+	host = strings.ToLower(host)
+	for _, name := range d.names {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifierURI 选择 SAML 应用的标识符 URI (entity id):
+//  1. idp 自身的 entity id 在已验证域名上时直接使用, 双方无需额外约定;
+//  2. 否则依次使用登录账号的域名、默认域名、初始域名 (*.onmicrosoft.com) 加 /saml/<orgID>;
+//  3. 读取已验证域名失败或没有可用的域名时返回错误, 不写入必然被拒绝的 URI.
+func (s *EntraService) identifierURI(ctx context.Context, idpConfig *IdpConfig, upnDomain, orgID string) (string, error) {
+	domains, err := s.listVerifiedDomains(ctx)
+	if err != nil {
+		return "", fmt.Errorf("list verified domains: %w", classifyOnboardingError(err))
+	}
+
+	if entityID, err := url.Parse(idpConfig.GetEntityID()); err == nil && domains.covers(entityID.Hostname()) {
+		return idpConfig.GetEntityID(), nil
+	}
+	for _, domain := range []string{upnDomain, domains.defaultName, domains.initialName} {
+		if domain != "" && domains.covers(domain) {
+			return fmt.Sprintf("https://%s/saml/%s", strings.ToLower(domain), orgID), nil
+		}
+	}
+	if len(domains.names) > 0 {
+		return fmt.Sprintf("https://%s/saml/%s", domains.names[0], orgID), nil
+	}
+	return "", newOnboardingError(ErrUnverifiedDomain, errors.New("the tenant has no verified domain"))
+}
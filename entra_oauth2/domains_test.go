@@ -0,0 +1,103 @@
+package entra_oauth2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifiedDomainsCovers(t *testing.T) {
+	domains := &verifiedDomains{names: []string{"contoso.com", "contoso.onmicrosoft.com"}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "contoso.com", want: true},
+		{host: "Contoso.COM", want: true},
+		{host: "idp.contoso.com", want: true},
+		{host: "a.b.contoso.onmicrosoft.com", want: true},
+		{host: "notcontoso.com", want: false},
+		{host: "contoso.com.evil.io", want: false},
+		{host: "com", want: false},
+		{host: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := domains.covers(tt.host); got != tt.want {
+				t.Errorf("covers(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+// organizationResponse lists the verified domains as {name, isDefault, isInitial}
+func organizationResponse(domains ...[3]string) string {
+	var entries []string
+	for _, d := range domains {
+		entries = append(entries, `{"name": "`+d[0]+`", "isDefault": `+d[1]+`, "isInitial": `+d[2]+`}`)
+	}
+	return `{"value": [{"id": "org", "verifiedDomains": [` + strings.Join(entries, ",") + `]}]}`
+}
+
+func TestIdentifierURI(t *testing.T) {
+	idpConfig := &IdpConfig{OrgProxyDomain: "idp.contoso.com", PathEntityID: "/saml/metadata"}
+	tests := []struct {
+		name      string
+		status    int
+		response  string
+		upnDomain string
+		want      string
+		wantErr   error
+	}{
+		{name: "entity id on a verified domain",
+			response:  organizationResponse([3]string{"contoso.com", "true", "false"}),
+			upnDomain: "fabrikam.com", want: "https://idp.contoso.com/saml/metadata"},
+		{name: "upn domain",
+			response:  organizationResponse([3]string{"fabrikam.onmicrosoft.com", "false", "true"}, [3]string{"fabrikam.com", "true", "false"}, [3]string{"sales.fabrikam.io", "false", "false"}),
+			upnDomain: "Sales.Fabrikam.io", want: "https://sales.fabrikam.io/saml/org-id"},
+		{name: "default domain",
+			response:  organizationResponse([3]string{"fabrikam.onmicrosoft.com", "false", "true"}, [3]string{"fabrikam.com", "true", "false"}),
+			upnDomain: "guest.example.org", want: "https://fabrikam.com/saml/org-id"},
+		{name: "initial domain",
+			response:  organizationResponse([3]string{"other.io", "false", "false"}, [3]string{"fabrikam.onmicrosoft.com", "false", "true"}),
+			upnDomain: "", want: "https://fabrikam.onmicrosoft.com/saml/org-id"},
+		{name: "first verified domain",
+			response:  organizationResponse([3]string{"other.io", "false", "false"}),
+			upnDomain: "", want: "https://other.io/saml/org-id"},
+		{name: "no verified domain",
+			response:  organizationResponse(),
+			upnDomain: "fabrikam.com", wantErr: ErrUnverifiedDomain},
+		{name: "listing forbidden",
+			status:    http.StatusForbidden,
+			upnDomain: "fabrikam.com", wantErr: ErrConsentMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := stubGraphService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1.0/organization" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if tt.status != 0 {
+					writeGraphError(w, tt.status, "Authorization_RequestDenied")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, tt.response)
+			}))
+
+			got, err := s.identifierURI(context.Background(), idpConfig, tt.upnDomain, "org-id")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || got != "" {
+					t.Fatalf("identifierURI = %q, %v; want error %v", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("identifierURI = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
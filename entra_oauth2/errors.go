@@ -0,0 +1,159 @@
+package entra_oauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 接入失败的错误类型, 用 errors.Is 判断, ErrorCode 返回对应的稳定错误码
+var (
+	// the admin did not grant consent, or the granted permissions are not enough
+	ErrConsentMissing = errors.New("admin consent missing")
+
+	// the identifier uri is not on a verified domain of the tenant
+	ErrUnverifiedDomain = errors.New("identifier uri is not on a verified domain")
+
+	// the application template does not exist
+	ErrTemplateNotFound = errors.New("application template not found")
+
+	// the scim endpoint rejected the tenant url or token
+	ErrScimCredentialsRejected = errors.New("scim credentials rejected")
+
+	// the synchronization job was quarantined
+	ErrSyncQuarantined = errors.New("synchronization job quarantined")
+
+	// the federation metadata is malformed, unsigned, expired or of another application
+	ErrInvalidMetadata = errors.New("federation metadata invalid")
+)
+
+// 错误码, 通过 HTTP 响应和接入结果返回给 UCS
+const (
+	CodeConsentMissing          = "consent_missing"
+	CodeUnverifiedDomain        = "unverified_domain"
+	CodeTemplateNotFound        = "template_not_found"
+	CodeScimCredentialsRejected = "scim_credentials_rejected"
+	CodeSyncQuarantined         = "sync_quarantined"
+	CodeInvalidMetadata         = "invalid_metadata"
+	CodeGraphThrottled          = "graph_throttled"
+	CodeGraphTransient          = "graph_transient"
+	CodeGraphNotFound           = "graph_not_found"
+	CodeGraphConflict           = "graph_conflict"
+	CodeGraphForbidden          = "graph_forbidden"
+	CodeGraphBadRequest         = "graph_bad_request"
+	CodeInternal                = "internal"
+)
+
+// scim 端点拒绝 tenant url 或令牌时 Graph 返回的错误码前缀
+// (SystemForCrossDomainIdentityManagementCredentialValidationUnavailable 等)
+const scimCredentialValidationCode = "SystemForCrossDomainIdentityManagementCredentialValidation"
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrConsentMissing, CodeConsentMissing},
+	{ErrUnverifiedDomain, CodeUnverifiedDomain},
+	{ErrTemplateNotFound, CodeTemplateNotFound},
+	{ErrScimCredentialsRejected, CodeScimCredentialsRejected},
+	{ErrSyncQuarantined, CodeSyncQuarantined},
+	{ErrInvalidMetadata, CodeInvalidMetadata},
+	{ErrGraphThrottled, CodeGraphThrottled},
+	{ErrGraphTransient, CodeGraphTransient},
+	{ErrGraphNotFound, CodeGraphNotFound},
+	{ErrGraphConflict, CodeGraphConflict},
+	{ErrGraphForbidden, CodeGraphForbidden},
+	{ErrGraphBadRequest, CodeGraphBadRequest},
+}
+
+// OnboardingError 将接入错误类型与底层错误 (通常是 Graph 错误) 关联
+type OnboardingError struct {
+	Kind error
+
+	// odata error code of the underlying graph error, if any
+	GraphCode string
+
+	err error
+}
+
+func (e *OnboardingError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.err)
+}
+
+func (e *OnboardingError) Unwrap() []error {
+	return []error{e.Kind, e.err}
+}
+
+// newOnboardingError 用 kind 包装 err, 同时保留 Graph 错误码
+func newOnboardingError(kind, err error) error {
+	onboardingErr := &OnboardingError{Kind: kind, err: classifyGraphError(err)}
+	if graphErr, ok := AsGraphError(err); ok {
+		onboardingErr.GraphCode = graphErr.Code
+	}
+	return onboardingErr
+}
+
+// classifyOnboardingError 识别 Graph 错误中可确定原因的失败, 其他错误只做 Graph 分类
+func classifyOnboardingError(err error) error {
+	err = classifyGraphError(err)
+	var onboardingErr *OnboardingError
+	if err == nil || errors.As(err, &onboardingErr) {
+		return err
+	}
+	graphErr, ok := AsGraphError(err)
+	if !ok {
+		return err
+	}
+	switch {
+	case graphErr.Code == "HostNameNotOnVerifiedDomain":
+		return newOnboardingError(ErrUnverifiedDomain, err)
+	case graphErr.Code == "Authorization_RequestDenied":
+		// 只有权限不足的错误码表示缺少同意, 其他 403 (如条件访问, 租户策略) 保留 Graph 分类
+		return newOnboardingError(ErrConsentMissing, err)
+	case strings.HasPrefix(graphErr.Code, scimCredentialValidationCode):
+		// validateCredentials 的凭据校验失败, 格式错误等其他 400 保留 Graph 分类
+		return newOnboardingError(ErrScimCredentialsRejected, err)
+	}
+	return err
+}
+
+// consentError 识别授权回调和令牌请求中管理员未同意的错误 (AADSTS65001 等)
+func consentError(err error) error {
+	message := err.Error()
+	for _, marker := range []string{"consent_required", "access_denied", "AADSTS65001", "AADSTS65004", "AADSTS90094"} {
+		if strings.Contains(message, marker) {
+			return newOnboardingError(ErrConsentMissing, err)
+		}
+	}
+	return err
+}
+
+// ErrorCode 返回错误的稳定错误码
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	err = classifyGraphError(err)
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// writeError 以 JSON 返回错误及其错误码
+func writeError(w http.ResponseWriter, status int, err error) {
+	response := map[string]string{"code": ErrorCode(err), "error": err.Error()}
+	var onboardingErr *OnboardingError
+	if errors.As(err, &onboardingErr) && onboardingErr.GraphCode != "" {
+		response["graph_code"] = onboardingErr.GraphCode
+	} else if graphErr, ok := AsGraphError(err); ok && graphErr.Code != "" {
+		response["graph_code"] = graphErr.Code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
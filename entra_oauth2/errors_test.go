@@ -0,0 +1,111 @@
+package entra_oauth2
+
+import (
+	"errors"
+	"fmt"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"net/http"
+	"testing"
+)
+
+// odataError builds the error the Graph SDK returns for a failed request
+func odataError(status int, code string) error {
+	mainErr := odataerrors.NewMainError()
+	mainErr.SetCode(&code)
+	err := odataerrors.NewODataError()
+	err.SetErrorEscaped(mainErr)
+	err.ResponseStatusCode = status
+	return err
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "plain error", err: errors.New("boom"), want: CodeInternal},
+		{name: "onboarding error", err: newOnboardingError(ErrSyncQuarantined, errors.New("quarantined")), want: CodeSyncQuarantined},
+		{name: "wrapped onboarding error", err: fmt.Errorf("step: %w", newOnboardingError(ErrInvalidMetadata, errors.New("unsigned"))), want: CodeInvalidMetadata},
+		{name: "throttled", err: odataError(http.StatusTooManyRequests, "TooManyRequests"), want: CodeGraphThrottled},
+		{name: "transient", err: odataError(http.StatusServiceUnavailable, "ServiceUnavailable"), want: CodeGraphTransient},
+		{name: "not found", err: odataError(http.StatusNotFound, "Request_ResourceNotFound"), want: CodeGraphNotFound},
+		{name: "forbidden", err: fmt.Errorf("wrapped: %w", odataError(http.StatusForbidden, "Forbidden")), want: CodeGraphForbidden},
+		{name: "bad request", err: odataError(http.StatusBadRequest, "Request_BadRequest"), want: CodeGraphBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorCode(tt.err); got != tt.want {
+				t.Errorf("ErrorCode = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyOnboardingError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCode      string
+		wantGraphCode string
+	}{
+		{name: "unverified domain", err: odataError(http.StatusBadRequest, "HostNameNotOnVerifiedDomain"),
+			wantCode: CodeUnverifiedDomain, wantGraphCode: "HostNameNotOnVerifiedDomain"},
+		{name: "consent missing", err: odataError(http.StatusForbidden, "Authorization_RequestDenied"),
+			wantCode: CodeConsentMissing, wantGraphCode: "Authorization_RequestDenied"},
+		{name: "other forbidden", err: odataError(http.StatusForbidden, "AccessDenied"), wantCode: CodeGraphForbidden},
+		{name: "scim credentials rejected", err: odataError(http.StatusBadRequest, "SystemForCrossDomainIdentityManagementCredentialValidationUnavailable"),
+			wantCode: CodeScimCredentialsRejected, wantGraphCode: "SystemForCrossDomainIdentityManagementCredentialValidationUnavailable"},
+		{name: "malformed request", err: odataError(http.StatusBadRequest, "Request_BadRequest"), wantCode: CodeGraphBadRequest},
+		{name: "already classified", err: newOnboardingError(ErrTemplateNotFound, odataError(http.StatusNotFound, "Request_ResourceNotFound")),
+			wantCode: CodeTemplateNotFound, wantGraphCode: "Request_ResourceNotFound"},
+		{name: "not a graph error", err: errors.New("boom"), wantCode: CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyOnboardingError(tt.err)
+			if got := ErrorCode(err); got != tt.wantCode {
+				t.Errorf("ErrorCode = %q, want %q", got, tt.wantCode)
+			}
+			var onboardingErr *OnboardingError
+			graphCode := ""
+			if errors.As(err, &onboardingErr) {
+				graphCode = onboardingErr.GraphCode
+			}
+			if graphCode != tt.wantGraphCode {
+				t.Errorf("GraphCode = %q, want %q", graphCode, tt.wantGraphCode)
+			}
+		})
+	}
+	if err := classifyOnboardingError(nil); err != nil {
+		t.Errorf("classifyOnboardingError(nil) = %v, want nil", err)
+	}
+}
+
+func TestConsentError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		consent bool
+	}{
+		{name: "callback consent required", err: errors.New("授权失败: consent_required"), consent: true},
+		{name: "callback access denied", err: errors.New("授权失败: access_denied"), consent: true},
+		{name: "not consented", err: errors.New("AADSTS65001: The user or administrator has not consented"), consent: true},
+		{name: "declined", err: errors.New("AADSTS65004: User declined to consent"), consent: true},
+		{name: "admin consent required", err: errors.New("AADSTS90094: An administrator must grant permission"), consent: true},
+		{name: "invalid grant", err: errors.New("AADSTS70008: The provided authorization code has expired")},
+		{name: "network", err: errors.New("dial tcp: connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := consentError(tt.err)
+			if got := errors.Is(err, ErrConsentMissing); got != tt.consent {
+				t.Errorf("consentError(%v) missing consent = %v, want %v", tt.err, got, tt.consent)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Error("consentError lost the original error")
+			}
+		})
+	}
+}
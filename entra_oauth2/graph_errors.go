@@ -0,0 +1,116 @@
+package entra_oauth2
+
+import (
+	"errors"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"idp-test-go/poll"
+	"net/http"
+)
+
+// Graph 错误分类, 用 errors.Is 判断
+var (
+	ErrGraphThrottled  = errors.New("graph: throttled")
+	ErrGraphTransient  = errors.New("graph: transient error")
+	ErrGraphNotFound   = errors.New("graph: not found")
+	ErrGraphConflict   = errors.New("graph: conflict")
+	ErrGraphForbidden  = errors.New("graph: forbidden")
+	ErrGraphBadRequest = errors.New("graph: bad request")
+	ErrGraphUnknown    = errors.New("graph: unexpected error")
+)
+
+// GraphError 是分类后的 Graph 调用错误, 保留原始错误链
+type GraphError struct {
+	// one of the ErrGraph* classes
+	Kind error
+
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+
+	err error
+}
+
+func (e *GraphError) Error() string {
+	return e.err.Error()
+}
+
+func (e *GraphError) Unwrap() []error {
+	return []error{e.Kind, e.err}
+}
+
+// Retryable reports whether the same call may succeed later
+func (e *GraphError) Retryable() bool {
+	return e.Kind == ErrGraphThrottled || e.Kind == ErrGraphTransient || e.Kind == ErrGraphNotFound && e.Code == "Request_ResourceNotFound"
+}
+
+// classifyGraphError 将错误链中的 OData 错误包装为 GraphError, 其他错误原样返回
+func classifyGraphError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *GraphError
+	if errors.As(err, &classified) {
+		return err
+	}
+	var odataErr *odataerrors.ODataError
+	if !errors.As(err, &odataErr) {
+		return err
+	}
+	graphErr := &GraphError{StatusCode: odataErr.ResponseStatusCode, err: err}
+	if mainErr := odataErr.GetErrorEscaped(); mainErr != nil {
+		graphErr.Code = stringValue(mainErr.GetCode())
+		graphErr.Message = stringValue(mainErr.GetMessage())
+		if inner := mainErr.GetInnerError(); inner != nil {
+			graphErr.RequestID = stringValue(inner.GetRequestId())
+		}
+	}
+	graphErr.Kind = graphErrorKind(graphErr.StatusCode, graphErr.Code)
+	return graphErr
+}
+
+// AsGraphError 返回错误链中分类后的 Graph 错误, OData 错误也会被分类
+func AsGraphError(err error) (*GraphError, bool) {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) {
+		return graphErr, true
+	}
+	if classified := classifyGraphError(err); classified != err {
+		return classified.(*GraphError), true
+	}
+	return nil, false
+}
+
+func graphErrorKind(statusCode int, code string) error {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ErrGraphThrottled
+	case statusCode == http.StatusServiceUnavailable, statusCode == http.StatusGatewayTimeout,
+		statusCode == http.StatusBadGateway, statusCode == http.StatusInternalServerError:
+		return ErrGraphTransient
+	case statusCode == http.StatusNotFound:
+		return ErrGraphNotFound
+	case statusCode == http.StatusConflict, statusCode == http.StatusPreconditionFailed:
+		return ErrGraphConflict
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return ErrGraphForbidden
+	case statusCode == http.StatusBadRequest && code == "Request_ResourceNotFound":
+		// some endpoints report an unreplicated object as a bad request
+		return ErrGraphNotFound
+	case statusCode == http.StatusBadRequest:
+		return ErrGraphBadRequest
+	default:
+		return ErrGraphUnknown
+	}
+}
+
+// pollError 将不可重试的 Graph 错误标记为永久错误, 轮询立即结束
+func pollError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if graphErr, ok := AsGraphError(err); ok && (graphErr.Kind == ErrGraphForbidden || graphErr.Kind == ErrGraphBadRequest) {
+		return poll.Permanent(graphErr)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package entra_oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	khttp "github.com/microsoft/kiota-http-go"
+	msgraphgocore "github.com/microsoftgraph/msgraph-sdk-go-core"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	graphMaxRetries = 5
+
+	// 新建对象复制到所有副本前读取会返回 Request_ResourceNotFound, 只做少量重试
+	graphReplicationRetries = 3
+
+	graphMaxRetryDelay = time.Minute
+
+	graphClientTimeout = 5 * time.Minute
+)
+
+// graphRetryHandler 替换 kiota 默认的重试中间件:
+// 429 按 Retry-After 重试所有请求 (被限流的请求不会被执行);
+// 502/503/504 只重试幂等请求;
+// 刚创建的对象返回 Request_ResourceNotFound 时重试非 DELETE 请求.
+type graphRetryHandler struct{}
+
+func (h graphRetryHandler) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := pipeline.Next(req, middlewareIndex)
+		if err != nil {
+			return resp, err
+		}
+		retries, ok := h.retries(req, resp)
+		if !ok || attempt > retries || !rewind(req) {
+			return resp, nil
+		}
+
+		delay := retryDelay(resp, attempt)
+		log.Printf("🔁 graph %s %s returned %d, retry %d/%d in %v", req.Method, req.URL.Path, resp.StatusCode, attempt, retries, delay.Round(time.Millisecond))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		req.Header.Set("Retry-Attempt", strconv.Itoa(attempt))
+	}
+}
+
+// retries 返回该响应允许的重试次数
+func (h graphRetryHandler) retries(req *http.Request, resp *http.Response) (int, bool) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return graphMaxRetries, true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return graphMaxRetries, idempotent(req.Method)
+	case http.StatusNotFound, http.StatusBadRequest:
+		if req.Method == http.MethodDelete || responseErrorCode(resp) != "Request_ResourceNotFound" {
+			return 0, false
+		}
+		return graphReplicationRetries, true
+	}
+	return 0, false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// responseErrorCode 读取 OData 错误码, 响应体会被还原供后续解析
+func responseErrorCode(resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var odata struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &odata)
+	return odata.Error.Code
+}
+
+// rewind 将请求体重置到开头, 无法重置时不重试
+func rewind(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if seeker, ok := req.Body.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekStart)
+		return err == nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return false
+		}
+		req.Body = body
+		return true
+	}
+	return false
+}
+
+// retryDelay 优先使用 Retry-After, 否则指数退避并加入随机抖动
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	delay := time.Duration(1<<(attempt-1)) * time.Second
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			delay = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(retryAfter); err == nil {
+			delay = time.Until(t)
+		}
+	} else {
+		delay += time.Duration(rand.Int64N(int64(delay) / 2))
+	}
+	return min(max(delay, 0), graphMaxRetryDelay)
+}
+
+// graphMiddlewares 返回 Graph 默认中间件, 其中的重试中间件替换为 graphRetryHandler
+func graphMiddlewares() []khttp.Middleware {
+	middlewares := msgraphgocore.GetDefaultMiddlewaresWithOptions(&msgraphgocore.GraphClientOptions{})
+	for i, middleware := range middlewares {
+		if _, ok := middleware.(*khttp.RetryHandler); ok {
+			middlewares[i] = graphRetryHandler{}
+		}
+	}
+	return middlewares
+}
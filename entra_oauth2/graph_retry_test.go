@@ -0,0 +1,119 @@
+package entra_oauth2
+
+import (
+	khttp "github.com/microsoft/kiota-http-go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// graphStub answers each request with the next status of a script, repeating
+// the last one, and records the bodies it received
+type graphStub struct {
+	mu       sync.Mutex
+	statuses []int
+	code     string
+	bodies   []string
+}
+
+func (g *graphStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	g.mu.Lock()
+	g.bodies = append(g.bodies, string(body))
+	status := g.statuses[min(len(g.bodies), len(g.statuses))-1]
+	g.mu.Unlock()
+
+	w.Header().Set("Retry-After", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status >= 400 {
+		io.WriteString(w, `{"error": {"code": "`+g.code+`", "message": "stub"}}`)
+	}
+}
+
+func TestGraphRetryHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		statuses   []int
+		code       string
+		wantStatus int
+		wantCalls  int
+	}{
+		{"429 on POST retried", http.MethodPost, []int{429, 429, 201}, "TooManyRequests", 201, 3},
+		{"429 gives up after the max retries", http.MethodGet, []int{429}, "TooManyRequests", 429, graphMaxRetries + 1},
+		{"503 on GET retried", http.MethodGet, []int{503, 200}, "ServiceUnavailable", 200, 2},
+		{"503 on PATCH retried", http.MethodPatch, []int{503, 204}, "ServiceUnavailable", 204, 2},
+		{"503 on POST not retried", http.MethodPost, []int{503, 201}, "ServiceUnavailable", 503, 1},
+		{"504 on POST not retried", http.MethodPost, []int{504, 201}, "GatewayTimeout", 504, 1},
+		{"replication lag retried", http.MethodGet, []int{404, 200}, "Request_ResourceNotFound", 200, 2},
+		{"replication lag on DELETE not retried", http.MethodDelete, []int{404, 204}, "Request_ResourceNotFound", 404, 1},
+		{"plain 404 not retried", http.MethodGet, []int{404, 200}, "ResourceNotFound", 404, 1},
+		{"403 not retried", http.MethodPost, []int{403, 201}, "Authorization_RequestDenied", 403, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &graphStub{statuses: tt.statuses, code: tt.code}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			client := khttp.GetDefaultClient(graphRetryHandler{})
+			req, err := http.NewRequest(tt.method, server.URL+"/v1.0/applications", strings.NewReader(`{"displayName": "app"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if len(stub.bodies) != tt.wantCalls {
+				t.Errorf("server called %d times, want %d", len(stub.bodies), tt.wantCalls)
+			}
+			for i, body := range stub.bodies {
+				if body != `{"displayName": "app"}` {
+					t.Errorf("attempt %d sent body %q, want the original body", i+1, body)
+				}
+			}
+			if tt.wantStatus >= 400 && responseErrorCode(resp) != tt.code {
+				t.Errorf("final response body lost the error code %s", tt.code)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		attempt    int
+		min, max   time.Duration
+	}{
+		{"retry-after seconds", "7", 1, 7 * time.Second, 7 * time.Second},
+		{"retry-after capped", "3600", 1, graphMaxRetryDelay, graphMaxRetryDelay},
+		{"retry-after in the past", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 1, 0, 0},
+		{"retry-after date", time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 1, 8 * time.Second, 10 * time.Second},
+		{"backoff first attempt", "", 1, time.Second, 1500 * time.Millisecond},
+		{"backoff third attempt", "", 3, 4 * time.Second, 6 * time.Second},
+		{"backoff capped", "", 10, graphMaxRetryDelay, graphMaxRetryDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			if delay := retryDelay(resp, tt.attempt); delay < tt.min || delay > tt.max {
+				t.Errorf("retryDelay = %v, want between %v and %v", delay, tt.min, tt.max)
+			}
+		})
+	}
+}
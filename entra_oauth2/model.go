@@ -57,6 +57,18 @@ type IdpConfig struct {
 	UniqueID string `json:"unique_id"`
 }
 
+// Redacted returns a copy that is safe to log
+func (idpConfig *IdpConfig) Redacted() *IdpConfig {
+	if idpConfig == nil {
+		return nil
+	}
+	redacted := *idpConfig
+	if redacted.ScimToken != "" {
+		redacted.ScimToken = "***"
+	}
+	return &redacted
+}
+
 func (idpConfig *IdpConfig) GetEntityID() string {
 	return "https://" + idpConfig.OrgProxyDomain + idpConfig.PathEntityID
 }
@@ -0,0 +1,301 @@
+package entra_oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	msgraphsdkgo "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"idp-test-go/config"
+	"log"
+	"strings"
+	"time"
+)
+
+type OnboardingStep string
+
+const (
+	StepCreateApplication     OnboardingStep = "create_application"
+	StepInitIdp               OnboardingStep = "init_idp"
+	StepConfigureSAML         OnboardingStep = "configure_saml"
+	StepConfigureProvisioning OnboardingStep = "configure_provisioning"
+)
+
+// AllOnboardingSteps 完整的企业应用 + SAML + SCIM 配置流程, 按执行顺序排列.
+// idp 先初始化, 应用程序的名称和标签由 idp unique id 决定.
+var AllOnboardingSteps = []OnboardingStep{
+	StepInitIdp,
+	StepCreateApplication,
+	StepConfigureSAML,
+	StepConfigureProvisioning,
+}
+
+type StepStatus string
+
+const (
+	StepSucceeded StepStatus = "succeeded"
+	StepFailed    StepStatus = "failed"
+	StepSkipped   StepStatus = "skipped"
+
+	// the step succeeded in an earlier run of the same tenant's workflow
+	StepPreviouslySucceeded StepStatus = "previously_succeeded"
+)
+
+type StepResult struct {
+	Step       OnboardingStep `json:"step"`
+	Status     StepStatus     `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Code       string         `json:"code,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+}
+
+type OnboardingResult struct {
+	TenantID           string       `json:"tenant_id"`
+	Status             string       `json:"status"` // succeeded or failed
+	Error              string       `json:"error,omitempty"`
+	Code               string       `json:"code,omitempty"`
+	AppID              string       `json:"app_id,omitempty"`
+	ServicePrincipalID string       `json:"service_principal_id,omitempty"`
+	EntityID           string       `json:"entity_id,omitempty"`
+	Steps              []StepResult `json:"steps"`
+	RolledBack         bool         `json:"rolled_back,omitempty"`
+	FinishedAt         time.Time    `json:"finished_at"`
+}
+
+// 接入结果状态
+const (
+	OnboardingSucceeded = "succeeded"
+	OnboardingFailed    = "failed"
+)
+
+// finish 根据 Run 返回的错误填写整体状态和错误码
+func (result *OnboardingResult) finish(err error) {
+	result.Status = OnboardingSucceeded
+	if err != nil {
+		result.Status = OnboardingFailed
+		result.Error = err.Error()
+		result.Code = ErrorCode(err)
+	}
+	result.FinishedAt = time.Now()
+}
+
+// ParseOnboardingSteps 解析逗号分隔的步骤列表, "all" 表示全部步骤, 空字符串表示不执行
+func ParseOnboardingSteps(value string) ([]OnboardingStep, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	if value == "all" {
+		return AllOnboardingSteps, nil
+	}
+	var steps []OnboardingStep
+	for _, name := range strings.Split(value, ",") {
+		step := OnboardingStep(strings.TrimSpace(name))
+		if !containsStep(AllOnboardingSteps, step) {
+			return nil, fmt.Errorf("unknown onboarding step %q", name)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func containsStep(steps []OnboardingStep, step OnboardingStep) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Onboarder 驱动租户的接入流程: 初始化 idp → 创建企业应用 → 配置 SAML → 配置 SCIM 同步
+type Onboarder struct {
+	service     *EntraService
+	enabled     []OnboardingStep
+	application ApplicationSpec
+	claims      *ClaimsSpec
+}
+
+// NewOnboarder 创建只执行 steps 中步骤的 Onboarder, 未指定时执行全部步骤
+func (s *EntraService) NewOnboarder(steps ...OnboardingStep) *Onboarder {
+	if len(steps) == 0 {
+		steps = AllOnboardingSteps
+	}
+	return &Onboarder{service: s, enabled: steps, application: DefaultApplicationSpec(s.cfg.Application), claims: s.claims}
+}
+
+// WithApplicationSpec 设置本次接入实例化的企业应用参数
+func (o *Onboarder) WithApplicationSpec(spec ApplicationSpec) *Onboarder {
+	o.application = spec
+	return o
+}
+
+// onboardingRun 保存一次执行中各步骤之间传递的数据
+type onboardingRun struct {
+	service     *EntraService
+	tokenResult *confidential.AuthResult
+	app         models.Applicationable
+	sp          models.ServicePrincipalable
+	idpConfig   *IdpConfig
+	record      *WorkflowRecord
+}
+
+type onboardingStepFunc func(ctx context.Context, run *onboardingRun) error
+
+func (o *Onboarder) stepFunc(step OnboardingStep) onboardingStepFunc {
+	switch step {
+	case StepCreateApplication:
+		return func(ctx context.Context, run *onboardingRun) error {
+			if run.idpConfig == nil {
+				return fmt.Errorf("requires step %s", StepInitIdp)
+			}
+			app, sp, err := run.service.createApplication(ctx, o.application, run.idpConfig, run.record)
+			if err != nil {
+				return err
+			}
+			run.app, run.sp = app, sp
+			return nil
+		}
+	case StepInitIdp:
+		return func(ctx context.Context, run *onboardingRun) error {
+			idpConfig, err := run.service.getIdpInit(ctx)
+			if err != nil {
+				return err
+			}
+			if idpConfig == nil {
+				return errors.New("ucs returned no idp config")
+			}
+			run.idpConfig = idpConfig
+			run.record.Idp = idpConfig
+			return nil
+		}
+	case StepConfigureSAML:
+		return func(ctx context.Context, run *onboardingRun) error {
+			if err := run.require(); err != nil {
+				return err
+			}
+			return run.service.configurationSAML(ctx, run.app, run.sp, o.claims, run.idpConfig, run.tokenResult, run.record)
+		}
+	case StepConfigureProvisioning:
+		return func(ctx context.Context, run *onboardingRun) error {
+			if err := run.require(); err != nil {
+				return err
+			}
+			return run.service.configurationProvisioning(ctx, run.sp, run.idpConfig, run.record)
+		}
+	}
+	return nil
+}
+
+// require 检查前置步骤的产出是否存在
+func (run *onboardingRun) require() error {
+	if run.app == nil || run.sp == nil {
+		return fmt.Errorf("requires step %s", StepCreateApplication)
+	}
+	if run.idpConfig == nil {
+		return fmt.Errorf("requires step %s", StepInitIdp)
+	}
+	return nil
+}
+
+// restore 恢复此前已完成步骤的产出
+func (run *onboardingRun) restore(ctx context.Context) error {
+	record := run.record
+	if record.completed(StepCreateApplication) && !record.completed(StepInitIdp) {
+		// 旧顺序 (先创建应用再初始化 idp) 保存的记录: 应用未绑定任何 idp,
+		// 在 init_idp 之后重新执行 create_application, 复用该应用并打上新 idp 的标签
+		log.Printf("♻️  application %s was created before the idp, tag it again after %s", record.AppID, StepInitIdp)
+		delete(record.Steps, StepCreateApplication)
+	}
+	if record.completed(StepCreateApplication) {
+		app, sp, err := run.service.getApplication(ctx, record.AppID, record.ServicePrincipalID)
+		if err != nil {
+			return err
+		}
+		run.app, run.sp = app, sp
+	}
+	if record.completed(StepInitIdp) {
+		run.idpConfig = record.Idp
+	}
+	return nil
+}
+
+// Run 依次执行启用的步骤, 任一步骤失败即停止, 返回每个步骤的结果.
+// 进度按租户持久化, 重新执行时跳过已成功的步骤并复用已创建的资源.
+func (o *Onboarder) Run(ctx context.Context, tokenResult *confidential.AuthResult) (*OnboardingResult, error) {
+	tenantID := tenantIDOf(tokenResult)
+	if tenantID == "" {
+		return nil, errors.New("auth result has no tenant id")
+	}
+	record, err := o.service.workflows.load(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("load workflow record failed: %w", err)
+	}
+	record.HomeAccountID = tokenResult.Account.HomeAccountID
+
+	graphClient, err := o.service.NewGraphServiceClient(tokenResult)
+	if err != nil {
+		return nil, err
+	}
+	run := &onboardingRun{
+		service:     o.service.withGraphClient(graphClient),
+		tokenResult: tokenResult,
+		record:      record,
+	}
+	if err := run.restore(ctx); err != nil {
+		return nil, fmt.Errorf("restore workflow failed: %w", err)
+	}
+
+	result := &OnboardingResult{TenantID: tenantID}
+	var runErr error
+	for _, step := range AllOnboardingSteps {
+		stepResult := StepResult{Step: step, StartedAt: time.Now()}
+		switch {
+		case record.completed(step):
+			stepResult.Status = StepPreviouslySucceeded
+		case runErr != nil || !containsStep(o.enabled, step):
+			stepResult.Status = StepSkipped
+		default:
+			log.Printf("▶️  onboarding step %s", step)
+			if err := classifyOnboardingError(o.stepFunc(step)(ctx, run)); err != nil {
+				stepResult.Status = StepFailed
+				stepResult.Error = err.Error()
+				stepResult.Code = ErrorCode(err)
+				runErr = fmt.Errorf("onboarding step %s failed: %w", step, err)
+				log.Printf("❌ onboarding step %s failed: %v", step, err)
+			} else {
+				stepResult.Status = StepSucceeded
+				log.Printf("✅ onboarding step %s succeeded", step)
+			}
+			// checkpoint, also on failure to keep the ids of resources already created
+			record.Steps[step] = stepResult.Status
+			if err := o.service.workflows.save(ctx, record); err != nil {
+				log.Printf("⚠️  save workflow record failed: %v", err)
+			}
+		}
+		stepResult.FinishedAt = time.Now()
+		result.Steps = append(result.Steps, stepResult)
+	}
+
+	result.AppID = record.AppID
+	result.ServicePrincipalID = record.ServicePrincipalID
+	result.EntityID = record.EntityID
+
+	if runErr != nil && o.service.cfg.OnFailure == config.OnFailureRollback {
+		log.Printf("↩️  rollback tenant %s", tenantID)
+		if err := run.service.rollback(ctx, record); err != nil {
+			return result, errors.Join(runErr, fmt.Errorf("rollback failed: %w", err))
+		}
+		result.RolledBack = true
+	}
+	return result, runErr
+}
+
+// withGraphClient 返回使用指定 Graph 客户端的浅拷贝, 避免并发接入的租户互相覆盖 graphClient
+func (s *EntraService) withGraphClient(graphClient *msgraphsdkgo.GraphServiceClient) *EntraService {
+	clone := *s
+	clone.graphClient = graphClient
+	return &clone
+}
@@ -0,0 +1,29 @@
+package entra_oauth2
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRestoreApplicationCreatedBeforeIdp(t *testing.T) {
+	// saved under the former order, create_application ran before init_idp failed
+	record := newWorkflowRecord("tenant")
+	record.AppID = "app"
+	record.ServicePrincipalID = "sp"
+	record.Steps[StepCreateApplication] = StepSucceeded
+	record.Steps[StepInitIdp] = StepFailed
+
+	run := &onboardingRun{service: &EntraService{}, record: record}
+	if err := run.restore(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if record.completed(StepCreateApplication) {
+		t.Errorf("%s still completed, the application would keep belonging to no idp", StepCreateApplication)
+	}
+	if record.AppID != "app" || record.ServicePrincipalID != "sp" {
+		t.Errorf("application ids = %s/%s, want app/sp kept for reuse", record.AppID, record.ServicePrincipalID)
+	}
+	if run.app != nil || run.idpConfig != nil {
+		t.Error("restore produced outputs of steps that must run again")
+	}
+}
@@ -0,0 +1,31 @@
+package entra_oauth2
+
+import (
+	"idp-test-go/poll"
+	"log"
+	"time"
+)
+
+// poller 按配置的退避策略创建轮询器, 每次检查的结果写入日志
+func (s *EntraService) poller(timeout time.Duration) poll.Poller {
+	initial, maxInterval := s.cfg.Polling.Backoff()
+	return poll.Poller{
+		InitialInterval: initial,
+		MaxInterval:     maxInterval,
+		Jitter:          s.cfg.Polling.JitterFraction(),
+		Timeout:         timeout,
+		OnEvent:         logPollEvent,
+	}
+}
+
+func logPollEvent(e poll.Event) {
+	elapsed := e.Elapsed.Round(time.Second)
+	switch {
+	case e.Ready:
+		log.Printf("✅ %s已就绪，耗时: %v (第 %d 次检查)", e.Probe, elapsed, e.Attempt)
+	case e.Err != nil:
+		log.Printf("⚠️  检查%s状态时出错: %v (已等待 %v, %v 后重试)", e.Probe, e.Err, elapsed, e.NextDelay.Round(time.Millisecond))
+	default:
+		log.Printf("🔄 %s尚未就绪: %s，继续等待... (已等待 %v, %v 后重试)", e.Probe, e.Pending, elapsed, e.NextDelay.Round(time.Millisecond))
+	}
+}
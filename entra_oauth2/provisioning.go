@@ -2,14 +2,16 @@ package entra_oauth2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/microsoftgraph/msgraph-sdk-go/serviceprincipals"
+	"idp-test-go/poll"
+	"idp-test-go/secrets"
 	"log"
-	"time"
 )
 
-func (s *EntraService) configurationProvisioning(ctx context.Context, sp models.ServicePrincipalable, idpConfig *IdpConfig) error {
+func (s *EntraService) configurationProvisioning(ctx context.Context, sp models.ServicePrincipalable, idpConfig *IdpConfig, record *WorkflowRecord) error {
 	spID := sp.GetId()
 
 	// 第一步：验证管理员凭据
@@ -22,19 +24,24 @@ func (s *EntraService) configurationProvisioning(ctx context.Context, sp models.
 		return fmt.Errorf("配置同步设置失败: %w", err)
 	}
 
-	// 第三步：创建同步作业
-	job, err := s.createSynchronizationJob(ctx, *spID)
-	if err != nil {
-		return fmt.Errorf("创建同步作业失败: %w", err)
+	// 第三步：创建同步作业, 上次执行已创建时复用
+	if record.JobID == "" {
+		job, err := s.createSynchronizationJob(ctx, *spID)
+		if err != nil {
+			return fmt.Errorf("创建同步作业失败: %w", err)
+		}
+		record.JobID = *job.GetId()
+	} else {
+		log.Printf("♻️  复用已创建的同步作业: %s", record.JobID)
 	}
 
 	// 第四步：等待作业创建完成
-	if err = s.waitForJobReady(ctx, *spID, *job.GetId()); err != nil {
+	if err := s.waitForJobReady(ctx, *spID, record.JobID); err != nil {
 		return fmt.Errorf("等待同步作业就绪失败: %w", err)
 	}
 
 	// 第五步：启动同步作业
-	if err := s.startSynchronizationJob(ctx, *spID, *job.GetId()); err != nil {
+	if err := s.startSynchronizationJob(ctx, *spID, record.JobID); err != nil {
 		return fmt.Errorf("启动同步作业失败: %w", err)
 	}
 	return nil
@@ -43,6 +50,11 @@ func (s *EntraService) configurationProvisioning(ctx context.Context, sp models.
 func (s *EntraService) validateCredentials(ctx context.Context, spID string, idpConfig *IdpConfig) error {
 	log.Printf("🔍 验证管理员凭据")
 
+	scimToken, err := s.scimToken(ctx, idpConfig)
+	if err != nil {
+		return err
+	}
+
 	// 准备凭据
 	pair1 := models.NewSynchronizationSecretKeyStringValuePair()
 	pair1.SetKey(pointer(models.BASEADDRESS_SYNCHRONIZATIONSECRET))
@@ -50,7 +62,7 @@ func (s *EntraService) validateCredentials(ctx context.Context, spID string, idp
 
 	pair2 := models.NewSynchronizationSecretKeyStringValuePair()
 	pair2.SetKey(pointer(models.SECRETTOKEN_SYNCHRONIZATIONSECRET))
-	pair2.SetValue(pointer(idpConfig.ScimToken))
+	pair2.SetValue(pointer(scimToken))
 
 	pairs := []models.SynchronizationSecretKeyStringValuePairable{pair1, pair2}
 
@@ -61,10 +73,10 @@ func (s *EntraService) validateCredentials(ctx context.Context, spID string, idp
 	validateParams.SetUseSavedCredentials(pointer(false))
 
 	// 验证凭据
-	err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+	err = s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
 		Synchronization().Jobs().ValidateCredentials().Post(ctx, validateParams, nil)
 	if err != nil {
-		return fmt.Errorf("验证凭据失败: %s", err.Error())
+		return fmt.Errorf("验证凭据失败: %w", classifyOnboardingError(err))
 	}
 
 	log.Printf("✅ 管理员凭据验证成功")
@@ -75,6 +87,11 @@ func (s *EntraService) validateCredentials(ctx context.Context, spID string, idp
 func (s *EntraService) configureCredentials(ctx context.Context, spID string, idpConfig *IdpConfig) error {
 	log.Printf("🔧 配置同步设置")
 
+	scimToken, err := s.scimToken(ctx, idpConfig)
+	if err != nil {
+		return err
+	}
+
 	// 准备所有凭据
 	pair1 := models.NewSynchronizationSecretKeyStringValuePair()
 	pair1.SetKey(pointer(models.BASEADDRESS_SYNCHRONIZATIONSECRET))
@@ -82,7 +99,7 @@ func (s *EntraService) configureCredentials(ctx context.Context, spID string, id
 
 	pair2 := models.NewSynchronizationSecretKeyStringValuePair()
 	pair2.SetKey(pointer(models.SECRETTOKEN_SYNCHRONIZATIONSECRET))
-	pair2.SetValue(pointer(idpConfig.ScimToken))
+	pair2.SetValue(pointer(scimToken))
 
 	//pair3 := models.NewSynchronizationSecretKeyStringValuePair()
 	//pair3.SetKey(pointer(models.SYNCNOTIFICATIONSETTINGS_SYNCHRONIZATIONSECRET))
@@ -98,7 +115,7 @@ func (s *EntraService) configureCredentials(ctx context.Context, spID string, id
 	addCredParams := serviceprincipals.NewItemSynchronizationSecretsPutRequestBody()
 	addCredParams.SetValue(pairs)
 
-	_, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+	_, err = s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
 		Synchronization().Secrets().PutAsSecretsPutResponse(ctx, addCredParams, nil)
 	if err != nil {
 		return fmt.Errorf("应用同步配置失败: %w", err)
@@ -108,6 +125,23 @@ func (s *EntraService) configureCredentials(ctx context.Context, spID string, id
 	return nil
 }
 
+// scimToken 获取scim token, 优先使用 secret provider 中的 scim_token_<unique_id>, 其次使用 ucs 下发的 token
+func (s *EntraService) scimToken(ctx context.Context, idpConfig *IdpConfig) (string, error) {
+	if s.cfg.ScimTokenSecretPrefix != "" {
+		token, err := s.secrets.GetSecret(ctx, s.cfg.ScimTokenSecretPrefix+idpConfig.UniqueID)
+		if err == nil {
+			return token, nil
+		}
+		if !errors.Is(err, secrets.ErrSecretNotFound) {
+			return "", fmt.Errorf("获取scim token失败: %w", err)
+		}
+	}
+	if idpConfig.ScimToken == "" {
+		return "", fmt.Errorf("scim token missing for idp %s", idpConfig.UniqueID)
+	}
+	return idpConfig.ScimToken, nil
+}
+
 // createSynchronizationJob 创建同步作业
 func (s *EntraService) createSynchronizationJob(ctx context.Context, spID string) (models.SynchronizationJobable, error) {
 	log.Printf("🔄 创建同步作业")
@@ -128,62 +162,57 @@ func (s *EntraService) createSynchronizationJob(ctx context.Context, spID string
 // waitForJobReady 等待同步作业就绪
 func (s *EntraService) waitForJobReady(ctx context.Context, spID, jobID string) error {
 	log.Printf("⏳ 等待同步作业就绪...")
+	_, jobTimeout := s.cfg.Polling.Timeouts()
+	return s.poller(jobTimeout).Wait(ctx, poll.All("同步作业",
+		s.jobAccessibleProbe(spID, jobID),
+		s.jobSchemaProbe(spID, jobID),
+	))
+}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, 3*time.Minute)
-	defer cancel()
-
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	startTime := time.Now()
-
-	for {
-		select {
-		case <-timeoutCtx.Done():
-			return fmt.Errorf("等待同步作业就绪超时，已等待 %v", time.Since(startTime))
-
-		case <-ticker.C:
-			ready, err := s.checkJobReady(ctx, spID, jobID)
-			if err != nil {
-				log.Printf("⚠️  检查同步作业状态时出错: %v", err)
-				continue
-			}
-
-			if ready {
-				elapsed := time.Since(startTime)
-				log.Printf("✅ 同步作业已就绪，耗时: %v", elapsed)
-				return nil
-			}
-
-			log.Printf("🔄 同步作业尚未就绪，继续等待... (已等待 %v)", time.Since(startTime))
+// jobAccessibleProbe 检查同步作业是否可读取
+func (s *EntraService) jobAccessibleProbe(spID, jobID string) poll.Probe {
+	return poll.Probe{Name: "同步作业可访问", Check: func(ctx context.Context) (bool, error) {
+		job, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+			Synchronization().Jobs().BySynchronizationJobId(jobID).Get(ctx, nil)
+		if err != nil {
+			return false, pollError(err)
 		}
-	}
+		if err := quarantineError(job); err != nil {
+			return false, poll.Permanent(err)
+		}
+		return job.GetId() != nil, nil
+	}}
 }
 
-// checkJobReady 检查同步作业是否就绪
-func (s *EntraService) checkJobReady(ctx context.Context, spID, jobID string) (bool, error) {
-	// 尝试获取同步作业
-	job, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
-		Synchronization().Jobs().BySynchronizationJobId(jobID).Get(ctx, nil)
-	if err != nil {
-		log.Printf("🔍 无法获取同步作业: %v", err)
-		return false, nil
-	}
+// jobSchemaProbe 检查同步作业的模式是否可用, 确认其完全就绪
+func (s *EntraService) jobSchemaProbe(spID, jobID string) poll.Probe {
+	return poll.Probe{Name: "同步作业模式可用", Check: func(ctx context.Context) (bool, error) {
+		_, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+			Synchronization().Jobs().BySynchronizationJobId(jobID).Schema().Get(ctx, nil)
+		return err == nil, pollError(err)
+	}}
+}
 
-	// 检查作业状态
-	if job.GetId() == nil {
-		return false, nil
+// quarantineError 作业被隔离时返回 ErrSyncQuarantined, 包含隔离原因
+func quarantineError(job models.SynchronizationJobable) error {
+	status := job.GetStatus()
+	if status == nil {
+		return nil
 	}
-
-	// 尝试获取作业的详细信息来确认其完全就绪
-	_, err = s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
-		Synchronization().Jobs().BySynchronizationJobId(jobID).Schema().Get(ctx, nil)
-	if err != nil {
-		log.Printf("🔍 同步作业模式不可用: %v", err)
-		return false, nil
+	quarantine := status.GetQuarantine()
+	if quarantine == nil && (status.GetCode() == nil || *status.GetCode() != models.QUARANTINE_SYNCHRONIZATIONSTATUSCODE) {
+		return nil
 	}
-
-	return true, nil
+	reason := "unknown"
+	if quarantine != nil {
+		if quarantine.GetReason() != nil {
+			reason = quarantine.GetReason().String()
+		}
+		if syncErr := quarantine.GetError(); syncErr != nil {
+			reason = fmt.Sprintf("%s, %s: %s", reason, stringValue(syncErr.GetCode()), stringValue(syncErr.GetMessage()))
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSyncQuarantined, reason)
 }
 
 // startSynchronizationJob 启动同步作业
@@ -0,0 +1,131 @@
+package entra_oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"idp-test-go/store"
+	"log"
+	"sync"
+	"time"
+)
+
+// msalCache 在多次创建的 confidential client 之间共享 MSAL token 缓存 (含 refresh token),
+// 缓存加密保存在 vault 中, 使用共享存储时各副本共用. 缓存按 MSAL 的 partition key
+// (用户 token 为 HomeAccountID) 分区保存, 每个租户的账号各自读写, 互不覆盖
+type msalCache struct {
+	store  store.CacheStore
+	prefix string
+}
+
+func (c *msalCache) Replace(ctx context.Context, u cache.Unmarshaler, hints cache.ReplaceHints) error {
+	if hints.PartitionKey == "" {
+		// 未指定账号的查询 (Account/AllAccounts) 不加载任何分区
+		return nil
+	}
+	data, err := c.store.LoadCache(ctx, c.prefix+hints.PartitionKey)
+	if errors.Is(err, store.ErrNotFound) {
+		// 清空上一个分区的内容, 避免其写回到本分区
+		return u.Unmarshal([]byte("{}"))
+	}
+	if err != nil {
+		return fmt.Errorf("load msal cache: %w", err)
+	}
+	return u.Unmarshal(data)
+}
+
+func (c *msalCache) Export(ctx context.Context, m cache.Marshaler, hints cache.ExportHints) error {
+	if hints.PartitionKey == "" {
+		return nil
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := c.store.SaveCache(ctx, c.prefix+hints.PartitionKey, data); err != nil {
+		return fmt.Errorf("save msal cache: %w", err)
+	}
+	return nil
+}
+
+// confidentialClient 创建 bootstrap app 的 MSAL client, 凭据每次重新获取以支持轮换, token 缓存共享.
+// 租户已知时使用该租户的 authority, 否则为 common
+func (s *EntraService) confidentialClient(ctx context.Context, tenantID string) (confidential.Client, error) {
+	cred, err := s.clientCredential(ctx)
+	if err != nil {
+		return confidential.Client{}, err
+	}
+	return confidential.New(s.cloud.Authority(tenantID), s.cfg.ClientID, cred,
+		confidential.WithCache(s.msalCache))
+}
+
+// RefreshingTokenCredential 基于 auth result 的账号, 在 RefreshOn/ExpiresOn 到达前通过 AcquireTokenSilent 刷新 token
+type RefreshingTokenCredential struct {
+	service *EntraService
+	account confidential.Account
+	scopes  []string
+
+	// authority 所用的客户租户, 与接入流程一致取自 tenantIDOf, 而不是账号的 Realm
+	tenantID string
+
+	mu    sync.Mutex
+	token azcore.AccessToken
+}
+
+func (s *EntraService) newRefreshingTokenCredential(tenantID string, account confidential.Account, token azcore.AccessToken) *RefreshingTokenCredential {
+	return &RefreshingTokenCredential{
+		service:  s,
+		account:  account,
+		scopes:   s.scopes,
+		tenantID: tenantID,
+		token:    token,
+	}
+}
+
+func (c *RefreshingTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.needsRefresh(time.Now()) {
+		return c.token, nil
+	}
+
+	client, err := c.service.confidentialClient(ctx, c.tenantID)
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	result, err := client.AcquireTokenSilent(ctx, c.scopes, confidential.WithSilentAccount(c.account))
+	if err != nil {
+		if time.Now().Before(c.token.ExpiresOn) {
+			// still usable, retry the refresh on the next call
+			log.Printf("⚠️  refresh token failed, keep current token: %v", err)
+			return c.token, nil
+		}
+		return azcore.AccessToken{}, fmt.Errorf("refresh token failed: %w", err)
+	}
+	if result.AccessToken == c.token.Token {
+		// MSAL 返回了缓存中的同一 token, 其 RefreshOn 已过, 改为按 ExpiresOn 判断, 避免每个请求都经过 MSAL
+		c.token.RefreshOn = time.Time{}
+		c.token.ExpiresOn = result.ExpiresOn
+		return c.token, nil
+	}
+	c.token = azcore.AccessToken{
+		Token:     result.AccessToken,
+		ExpiresOn: result.ExpiresOn,
+		RefreshOn: result.Metadata.RefreshOn,
+	}
+	log.Printf("🔄 token refreshed, expires_on: %s", result.ExpiresOn.Format(time.RFC3339))
+	return c.token, nil
+}
+
+// needsRefresh 到达 RefreshOn, 或没有 RefreshOn 时距 ExpiresOn 不足 5 分钟
+func (c *RefreshingTokenCredential) needsRefresh(now time.Time) bool {
+	if !c.token.RefreshOn.IsZero() {
+		return now.After(c.token.RefreshOn)
+	}
+	return now.After(c.token.ExpiresOn.Add(-5 * time.Minute))
+}
@@ -0,0 +1,211 @@
+package entra_oauth2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"log"
+	"net/http"
+)
+
+// compensation 撤销接入流程中创建的一项资源
+type compensation struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// compensations 按创建的逆序返回记录中资源的撤销操作: 同步作业 → 签名证书 → 服务主体 → 应用程序
+func (s *EntraService) compensations(record *WorkflowRecord) []compensation {
+	var actions []compensation
+	if record.JobID != "" && record.ServicePrincipalID != "" {
+		actions = append(actions, compensation{
+			name: "stop synchronization job " + record.JobID,
+			undo: func(ctx context.Context) error {
+				return s.deleteSynchronizationJob(ctx, record.ServicePrincipalID, record.JobID)
+			},
+		})
+	}
+	if record.CertKeyID != "" && record.ServicePrincipalID != "" {
+		actions = append(actions, compensation{
+			name: "remove token signing certificate " + record.CertKeyID,
+			undo: func(ctx context.Context) error {
+				return s.removeTokenSigningCertificate(ctx, record.ServicePrincipalID, record.CertKeyID)
+			},
+		})
+	}
+	if record.ServicePrincipalID != "" {
+		actions = append(actions, compensation{
+			name: "delete service principal " + record.ServicePrincipalID,
+			undo: func(ctx context.Context) error {
+				return s.graphClient.ServicePrincipals().ByServicePrincipalId(record.ServicePrincipalID).Delete(ctx, nil)
+			},
+		})
+	}
+	if record.ClaimsPolicyID != "" {
+		// after the service principal, a policy still assigned cannot be deleted
+		actions = append(actions, compensation{
+			name: "delete claims mapping policy " + record.ClaimsPolicyID,
+			undo: func(ctx context.Context) error {
+				return s.graphClient.Policies().ClaimsMappingPolicies().ByClaimsMappingPolicyId(record.ClaimsPolicyID).Delete(ctx, nil)
+			},
+		})
+	}
+	if record.AppID != "" {
+		actions = append(actions, compensation{
+			name: "delete application " + record.AppID,
+			undo: func(ctx context.Context) error {
+				return s.graphClient.Applications().ByApplicationId(record.AppID).Delete(ctx, nil)
+			},
+		})
+	}
+	return actions
+}
+
+// teardown 执行所有撤销操作, 已不存在的资源视为成功, 单个失败不影响后续操作
+func (s *EntraService) teardown(ctx context.Context, record *WorkflowRecord) error {
+	var errs []error
+	for _, action := range s.compensations(record) {
+		err := action.undo(ctx)
+		if err != nil && !isNotFound(err) {
+			log.Printf("❌ rollback %s failed: %v", action.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", action.name, err))
+			continue
+		}
+		log.Printf("↩️  rollback %s", action.name)
+	}
+	return errors.Join(errs...)
+}
+
+// deleteSynchronizationJob 暂停并删除同步作业
+func (s *EntraService) deleteSynchronizationJob(ctx context.Context, spID, jobID string) error {
+	job := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).
+		Synchronization().Jobs().BySynchronizationJobId(jobID)
+	if err := job.Pause().Post(ctx, nil); err != nil && !isNotFound(err) {
+		return err
+	}
+	return job.Delete(ctx, nil)
+}
+
+// removeTokenSigningCertificate 删除 AddTokenSigningCertificate 添加的签名/验证密钥及其私钥密码
+func (s *EntraService) removeTokenSigningCertificate(ctx context.Context, spID, keyID string) error {
+	sp, err := s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var customKeyIdentifier []byte
+	for _, key := range sp.GetKeyCredentials() {
+		if key.GetKeyId() != nil && key.GetKeyId().String() == keyID {
+			customKeyIdentifier = key.GetCustomKeyIdentifier()
+		}
+	}
+	if customKeyIdentifier == nil {
+		return nil
+	}
+
+	var keys []models.KeyCredentialable
+	for _, key := range sp.GetKeyCredentials() {
+		if !bytes.Equal(key.GetCustomKeyIdentifier(), customKeyIdentifier) {
+			keys = append(keys, key)
+		}
+	}
+	var passwords []models.PasswordCredentialable
+	for _, password := range sp.GetPasswordCredentials() {
+		if !bytes.Equal(password.GetCustomKeyIdentifier(), customKeyIdentifier) {
+			passwords = append(passwords, password)
+		}
+	}
+
+	updateSp := models.NewServicePrincipal()
+	updateSp.SetKeyCredentials(keys)
+	updateSp.SetPasswordCredentials(passwords)
+	_, err = s.graphClient.ServicePrincipals().ByServicePrincipalId(spID).Patch(ctx, updateSp, nil)
+	return err
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(classifyGraphError(err), ErrGraphNotFound)
+}
+
+// rollback 撤销失败流程创建的资源并删除流程记录, 之后重新执行将从头开始
+func (s *EntraService) rollback(ctx context.Context, record *WorkflowRecord) error {
+	if err := s.teardown(ctx, record); err != nil {
+		// keep the record so that a later offboard can finish the cleanup
+		return err
+	}
+	return s.workflows.delete(ctx, record.TenantID)
+}
+
+// OffboardTenant 删除租户接入时创建的企业应用、服务主体、签名证书和同步作业, 并清除流程记录
+func (s *EntraService) OffboardTenant(ctx context.Context, tokenResult *confidential.AuthResult) error {
+	graphClient, err := s.NewGraphServiceClient(tokenResult)
+	if err != nil {
+		return err
+	}
+	return s.withGraphClient(graphClient).offboard(ctx, tenantIDOf(tokenResult))
+}
+
+func (s *EntraService) offboard(ctx context.Context, tenantID string) error {
+	if tenantID == "" {
+		return errors.New("tenant id missing")
+	}
+	record, err := s.workflows.load(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	log.Printf("🧹 offboard tenant %s", tenantID)
+	return s.rollback(ctx, record)
+}
+
+// request from ucs
+// [POST] /tenant/offboard?tenant_id=
+// Authorization: Bearer <ucs api key>
+func (s *EntraService) HandleOffboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeUCS(w, r) {
+		return
+	}
+	tenantID := r.URL.Query().Get("tenant_id")
+	if tenantID == "" {
+		http.Error(w, "tenant_id missing", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	exists, err := s.workflows.exists(ctx, tenantID)
+	if err != nil {
+		http.Error(w, "load workflow record failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "tenant not onboarded", http.StatusNotFound)
+		return
+	}
+	record, err := s.workflows.load(ctx, tenantID)
+	if err != nil {
+		http.Error(w, "load workflow record failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	graphClient, err := s.graphClientForTenant(record)
+	if err != nil {
+		http.Error(w, "Failed to NewGraphServiceClient: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]string{"tenant_id": tenantID, "status": "offboarded"}
+	if err := s.withGraphClient(graphClient).offboard(ctx, tenantID); err != nil {
+		err = classifyOnboardingError(err)
+		response["status"] = "failed"
+		response["error"] = err.Error()
+		response["code"] = ErrorCode(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+}
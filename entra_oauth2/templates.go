@@ -0,0 +1,214 @@
+package entra_oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	msgraphsdkgo "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/applicationtemplates"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ApplicationTemplate 是 Entra 应用库中的一个模板, ID 可用作 entra.application.template_id
+type ApplicationTemplate struct {
+	ID                         string   `json:"id"`
+	DisplayName                string   `json:"display_name"`
+	Publisher                  string   `json:"publisher,omitempty"`
+	Description                string   `json:"description,omitempty"`
+	Categories                 []string `json:"categories"`
+	SupportedSSOModes          []string `json:"supported_sso_modes"`
+	SupportedProvisioningTypes []string `json:"supported_provisioning_types"`
+	HomePageURL                string   `json:"home_page_url,omitempty"`
+	LogoURL                    string   `json:"logo_url,omitempty"`
+}
+
+// defaultTemplateLimit 是未指定 limit 时最多返回的模板数
+const defaultTemplateLimit = 100
+
+// TemplateQuery 过滤应用模板, 空字段不过滤. Name 和 Category 由 Graph 服务端过滤,
+// 其余条件在返回的结果中过滤
+type TemplateQuery struct {
+	// case-insensitive substring of the display name
+	Name string
+
+	// category, e.g. "collaboration", "security"
+	Category string
+
+	// supported single sign-on mode, e.g. "saml", "oidc", "password"
+	SSOMode string
+
+	// only templates supporting automatic provisioning
+	Provisioning bool
+
+	// most templates returned, defaultTemplateLimit when zero
+	Limit int
+}
+
+// ParseTemplateQuery 从 name, category, sso, provisioning, limit 查询参数解析过滤条件
+func ParseTemplateQuery(values url.Values) (TemplateQuery, error) {
+	query := TemplateQuery{
+		Name:     values.Get("name"),
+		Category: values.Get("category"),
+		SSOMode:  values.Get("sso"),
+	}
+	if v := values.Get("provisioning"); v != "" {
+		provisioning, err := strconv.ParseBool(v)
+		if err != nil {
+			return query, fmt.Errorf("invalid provisioning %q", v)
+		}
+		query.Provisioning = provisioning
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return query, fmt.Errorf("invalid limit %q", v)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// filter 返回 Name 和 Category 对应的 $filter 表达式, 没有条件时返回 nil
+func (q TemplateQuery) filter() *string {
+	var clauses []string
+	if q.Name != "" {
+		clauses = append(clauses, fmt.Sprintf("contains(displayName, '%s')", odataString(q.Name)))
+	}
+	if q.Category != "" {
+		clauses = append(clauses, fmt.Sprintf("categories/any(c:c eq '%s')", odataString(strings.ToLower(q.Category))))
+	}
+	if len(clauses) == 0 {
+		return nil
+	}
+	return pointer(strings.Join(clauses, " and "))
+}
+
+func (q TemplateQuery) limit() int {
+	if q.Limit > 0 {
+		return q.Limit
+	}
+	return defaultTemplateLimit
+}
+
+func (q TemplateQuery) matches(t ApplicationTemplate) bool {
+	if q.Name != "" && !strings.Contains(strings.ToLower(t.DisplayName), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.Category != "" && !containsFold(t.Categories, q.Category) {
+		return false
+	}
+	if q.SSOMode != "" && !containsFold(t.SupportedSSOModes, q.SSOMode) {
+		return false
+	}
+	if q.Provisioning && len(t.SupportedProvisioningTypes) == 0 {
+		return false
+	}
+	return true
+}
+
+// SearchApplicationTemplates 使用给定的 Graph 客户端搜索应用库, 读到 limit 个符合条件的模板即停止翻页
+func SearchApplicationTemplates(ctx context.Context, graphClient *msgraphsdkgo.GraphServiceClient, query TemplateQuery) ([]ApplicationTemplate, error) {
+	config := &applicationtemplates.ApplicationTemplatesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &applicationtemplates.ApplicationTemplatesRequestBuilderGetQueryParameters{
+			Filter: query.filter(),
+			Select: []string{"id", "displayName", "publisher", "description", "categories",
+				"supportedSingleSignOnModes", "supportedProvisioningTypes", "homePageUrl", "logoUrl"},
+		},
+	}
+	page, err := graphClient.ApplicationTemplates().Get(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("list application templates failed: %w", err)
+	}
+
+	templates := []ApplicationTemplate{}
+	for {
+		for _, item := range page.GetValue() {
+			if t := newApplicationTemplate(item); query.matches(t) {
+				templates = append(templates, t)
+				if len(templates) >= query.limit() {
+					return templates, nil
+				}
+			}
+		}
+		next := page.GetOdataNextLink()
+		if next == nil || *next == "" {
+			return templates, nil
+		}
+		page, err = graphClient.ApplicationTemplates().WithUrl(*next).Get(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list application templates failed: %w", err)
+		}
+	}
+}
+
+// HandleTemplates 搜索应用模板
+// GET /templates?state=xxx&name=salesforce&category=crm&sso=saml&provisioning=true&limit=20
+func (s *EntraService) HandleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		http.Error(w, "state missing", http.StatusBadRequest)
+		return
+	}
+	query, err := ParseTemplateQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	token, err := s.tokens.GetToken(ctx, state)
+	if err != nil {
+		http.Error(w, "token not exist", http.StatusBadRequest)
+		return
+	}
+	graphClient, err := s.graphClientForToken(ctx, token)
+	if err != nil {
+		http.Error(w, "Failed to NewGraphServiceClient: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templates, err := SearchApplicationTemplates(ctx, graphClient, query)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, classifyOnboardingError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+func newApplicationTemplate(item models.ApplicationTemplateable) ApplicationTemplate {
+	return ApplicationTemplate{
+		ID:                         stringValue(item.GetId()),
+		DisplayName:                stringValue(item.GetDisplayName()),
+		Publisher:                  stringValue(item.GetPublisher()),
+		Description:                stringValue(item.GetDescription()),
+		Categories:                 item.GetCategories(),
+		SupportedSSOModes:          item.GetSupportedSingleSignOnModes(),
+		SupportedProvisioningTypes: item.GetSupportedProvisioningTypes(),
+		HomePageURL:                stringValue(item.GetHomePageUrl()),
+		LogoURL:                    stringValue(item.GetLogoUrl()),
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringValue(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
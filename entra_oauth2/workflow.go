@@ -0,0 +1,134 @@
+package entra_oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idp-test-go/store"
+	"log"
+	"strings"
+	"time"
+)
+
+// WorkflowRecord 记录一个租户接入流程的进度和已创建的资源, 重新执行时从上次完成的步骤继续
+type WorkflowRecord struct {
+	TenantID           string                        `json:"tenant_id"`
+	HomeAccountID      string                        `json:"home_account_id,omitempty"` // msal account that consented, for later silent token acquisition
+	AppID              string                        `json:"app_id,omitempty"`
+	AppClientID        string                        `json:"app_client_id,omitempty"`
+	ServicePrincipalID string                        `json:"service_principal_id,omitempty"`
+	CertKeyID          string                        `json:"cert_key_id,omitempty"`
+	JobID              string                        `json:"job_id,omitempty"`
+	EntityID           string                        `json:"entity_id,omitempty"` // saml identifier uri agreed with ucs
+	ClaimsPolicyID     string                        `json:"claims_policy_id,omitempty"`
+	Idp                *IdpConfig                    `json:"idp,omitempty"` // scim token is sealed in the vault, not stored here
+	Steps              map[OnboardingStep]StepStatus `json:"steps"`
+	CreatedAt          time.Time                     `json:"created_at"`
+	UpdatedAt          time.Time                     `json:"updated_at"`
+}
+
+func newWorkflowRecord(tenantID string) *WorkflowRecord {
+	now := time.Now()
+	return &WorkflowRecord{
+		TenantID:  tenantID,
+		Steps:     make(map[OnboardingStep]StepStatus),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (record *WorkflowRecord) completed(step OnboardingStep) bool {
+	return record.Steps[step] == StepSucceeded
+}
+
+// workflowStore 按租户持久化 WorkflowRecord, idp 的 scim token 单独加密保存,
+// 以便重新执行时跳过 init_idp 仍能配置同步
+type workflowStore struct {
+	backend store.Backend
+	sealed  store.CacheStore
+}
+
+func workflowKey(tenantID string) string {
+	return "workflow:" + tenantID
+}
+
+func scimTokenKey(tenantID string) string {
+	return "scim_token:" + tenantID
+}
+
+// tenants 返回所有有流程记录的租户
+func (w *workflowStore) tenants(ctx context.Context) ([]string, error) {
+	keys, err := w.backend.Keys(ctx, workflowKey(""))
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]string, 0, len(keys))
+	for _, key := range keys {
+		tenants = append(tenants, strings.TrimPrefix(key, workflowKey("")))
+	}
+	return tenants, nil
+}
+
+// exists 判断租户是否有记录
+func (w *workflowStore) exists(ctx context.Context, tenantID string) (bool, error) {
+	_, err := w.backend.Get(ctx, workflowKey(tenantID))
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// load 返回租户的记录, 不存在时返回新记录
+func (w *workflowStore) load(ctx context.Context, tenantID string) (*WorkflowRecord, error) {
+	data, err := w.backend.Get(ctx, workflowKey(tenantID))
+	if errors.Is(err, store.ErrNotFound) {
+		return newWorkflowRecord(tenantID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &WorkflowRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	if record.Steps == nil {
+		record.Steps = make(map[OnboardingStep]StepStatus)
+	}
+	if record.Idp != nil {
+		// 无法解密时 (如 vault 密钥未持久化) 只记录告警, 由需要 scim token 的步骤报错
+		token, err := w.sealed.LoadCache(ctx, scimTokenKey(tenantID))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("⚠️  load scim token of tenant %s failed: %v", tenantID, err)
+		}
+		record.Idp.ScimToken = string(token)
+	}
+	return record, nil
+}
+
+func (w *workflowStore) save(ctx context.Context, record *WorkflowRecord) error {
+	persisted := *record
+	persisted.UpdatedAt = time.Now()
+	if persisted.Idp != nil {
+		idp := *persisted.Idp
+		if idp.ScimToken != "" {
+			if err := w.sealed.SaveCache(ctx, scimTokenKey(record.TenantID), []byte(idp.ScimToken)); err != nil {
+				return fmt.Errorf("save scim token: %w", err)
+			}
+		}
+		idp.ScimToken = ""
+		persisted.Idp = &idp
+	}
+	data, err := json.Marshal(&persisted)
+	if err != nil {
+		return err
+	}
+	return w.backend.Set(ctx, workflowKey(record.TenantID), data, 0)
+}
+
+func (w *workflowStore) delete(ctx context.Context, tenantID string) error {
+	if err := w.sealed.DeleteCache(ctx, scimTokenKey(tenantID)); err != nil {
+		return err
+	}
+	return w.backend.Delete(ctx, workflowKey(tenantID))
+}
@@ -2,7 +2,7 @@ package google_oauth2
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"golang.org/x/oauth2"
@@ -10,44 +10,74 @@ import (
 	admin "google.golang.org/api/admin/directory/v1"
 	googleoauth "google.golang.org/api/oauth2/v2"
 	"google.golang.org/api/option"
+	"idp-test-go/config"
+	"idp-test-go/secrets"
+	"idp-test-go/store"
 	"log"
 	"net/http"
+	"time"
 )
 
-const (
-	clientID     = "688308718847-s0gksaaiqhnbq9ga82orlvg192fplqh0.apps.googleusercontent.com"
-	clientSecret = "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"
-	authUri      = "https://accounts.google.com/o/oauth2/auth"
-	tokenUri     = "https://oauth2.googleapis.com/token"
-	redirectURI  = "http://localhost:8080/auth/callback"
-)
+type GoogleService struct {
+	oauthConfig      *oauth2.Config
+	clientSecretName string
+	secrets          secrets.SecretProvider
+	states           store.StateStore
+}
 
-var oauthConfig = &oauth2.Config{
-	ClientID:     clientID,
-	ClientSecret: clientSecret,
-	RedirectURL:  redirectURI,
-	Scopes: []string{
-		"openid",
-		"profile",
-		"email",
-		"https://www.googleapis.com/auth/admin.directory.user.readonly",
-		"https://www.googleapis.com/auth/admin.directory.user",
-		"https://www.googleapis.com/auth/admin.directory.group",
-	},
-	Endpoint: google.Endpoint,
+func NewGoogleService(cfg config.GoogleConfig, secretProvider secrets.SecretProvider, backend store.Backend) (*GoogleService, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	endpoint := google.Endpoint
+	endpoint.AuthURL = cfg.AuthURI
+	endpoint.TokenURL = cfg.TokenURI
+	s := &GoogleService{
+		oauthConfig: &oauth2.Config{
+			ClientID:    cfg.ClientID,
+			RedirectURL: cfg.RedirectURI,
+			Scopes: []string{
+				"openid",
+				"profile",
+				"email",
+				"https://www.googleapis.com/auth/admin.directory.user.readonly",
+				"https://www.googleapis.com/auth/admin.directory.user",
+				"https://www.googleapis.com/auth/admin.directory.group",
+			},
+			Endpoint: endpoint,
+		},
+		clientSecretName: cfg.ClientSecretName,
+		secrets:          secretProvider,
+		states:           store.NewStateStore(backend),
+	}
+	return s, nil
 }
 
-func CallbackMethod() {
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/login", handleLogin)
-	http.HandleFunc("/auth/callback", handleCallback)
+func CallbackMethod(cfg *config.Config) {
+	secretProvider, err := secrets.New(cfg.Secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, err := store.New(context.Background(), cfg.Store, secretProvider)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer backend.Close()
+	s, err := NewGoogleService(cfg.Google, secretProvider, backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/", s.HandleHome)
+	http.HandleFunc("/login", s.HandleLogin)
+	http.HandleFunc("/auth/callback", s.HandleCallback)
 
-	port := "8080"
+	port := cfg.Server.Port
 	log.Printf("Server running on http://localhost:%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
+func (s *GoogleService) HandleHome(w http.ResponseWriter, r *http.Request) {
 	html := `
 	<!DOCTYPE html>
 	<html>
@@ -61,29 +91,56 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, html)
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	//u, _ := url.Parse(authUri)
+func (s *GoogleService) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	//u, _ := url.Parse(s.oauthConfig.Endpoint.AuthURL)
 	//queryParams := url.Values{}
 	//queryParams.Add("response_type", "code")
 	//queryParams.Add("scope", "openid profile email")
 	//queryParams.Add("prompt", "consent")
-	//queryParams.Add("client_id", clientID)
-	//queryParams.Add("redirect_uri", redirectURI)
+	//queryParams.Add("client_id", s.oauthConfig.ClientID)
+	//queryParams.Add("redirect_uri", s.oauthConfig.RedirectURL)
 	//u.RawQuery = queryParams.Encode()
 	//http.Redirect(w, r, u.String(), http.StatusFound)
-	url := oauthConfig.AuthCodeURL(uuid.New().String(), oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	state := uuid.New().String()
+	verifier := oauth2.GenerateVerifier()
+	err := s.states.SaveState(r.Context(), state, &store.State{Verifier: verifier, CreatedAt: time.Now()}, store.StateTTL)
+	if err != nil {
+		http.Error(w, "Save state error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	url := s.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce,
+		oauth2.S256ChallengeOption(verifier))
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func handleCallback(w http.ResponseWriter, r *http.Request) {
+func (s *GoogleService) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	code := r.URL.Query().Get("code")
 	if code == "" {
 		http.Error(w, "Authorization code missing", http.StatusBadRequest)
 		return
 	}
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		http.Error(w, "state missing", http.StatusBadRequest)
+		return
+	}
+	stateData, err := s.states.TakeState(ctx, state)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "state not exist", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Load state failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	tokenResult, err := getTokenResult(ctx, code)
+	oauthConfig, err := s.clientConfig(ctx)
+	if err != nil {
+		http.Error(w, "Load client secret error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokenResult, err := s.getTokenResult(ctx, oauthConfig, code, stateData.Verifier)
 	if err != nil {
 		http.Error(w, "Token exchange error: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -124,19 +181,31 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 			<h1>sign-on successfully</h1>
 			<p>Token: %s</p>
 		</body>
-	</html>`, tokenResult.AccessToken)
+	</html>`, secrets.Redact(tokenResult.AccessToken))
 	fmt.Fprintf(w, html)
 }
 
-func getTokenResult(ctx context.Context, code string) (*oauth2.Token, error) {
-	log.Printf("✅ getAccessToken code: %v \n", code)
+// clientConfig returns the oauth config completed with the client secret,
+// which is resolved per request and never stored on the service
+func (s *GoogleService) clientConfig(ctx context.Context) (*oauth2.Config, error) {
+	clientSecret, err := s.secrets.GetSecret(ctx, s.clientSecretName)
+	if err != nil {
+		return nil, err
+	}
+	oauthConfig := *s.oauthConfig
+	oauthConfig.ClientSecret = clientSecret
+	return &oauthConfig, nil
+}
+
+func (s *GoogleService) getTokenResult(ctx context.Context, oauthConfig *oauth2.Config, code, verifier string) (*oauth2.Token, error) {
+	log.Printf("✅ getAccessToken code: %v \n", secrets.Redact(code))
 
-	tokenResult, err := oauthConfig.Exchange(ctx, code)
+	tokenResult, err := oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, err
 	}
-	tokenJson, _ := json.Marshal(tokenResult)
-	log.Printf("✅ GetTokenFromCode %s  \n", string(tokenJson))
+	log.Printf("✅ GetTokenFromCode expiry: %s, access_token: %s  \n",
+		tokenResult.Expiry.Format(time.RFC3339), secrets.Redact(tokenResult.AccessToken))
 
 	return tokenResult, nil
 }
@@ -1,21 +1,136 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"idp-test-go/config"
 	"idp-test-go/entra_oauth2"
+	"idp-test-go/secrets"
+	"idp-test-go/store"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
 
-	entraService := entra_oauth2.NewEntraService()
+	// seal a secret for the encrypted secret provider:
+	// idp-test-go seal <key_file> < plaintext > <secrets.dir>/<name>.enc
+	if len(os.Args) == 3 && os.Args[1] == "seal" {
+		sealSecret(os.Args[2])
+		return
+	}
+
+	// search the application gallery:
+	// idp-test-go templates -token <graph_access_token> [-name salesforce] [-category crm] [-sso saml] [-provisioning] [-limit 20]
+	if len(os.Args) >= 2 && os.Args[1] == "templates" {
+		searchTemplates(os.Args[2:])
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secretProvider, err := secrets.New(cfg.Secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	backend, err := store.New(context.Background(), cfg.Store, secretProvider)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer backend.Close()
+
+	keyring, err := store.NewKeyring(cfg.Vault.KeyDir, cfg.Vault.RotateEvery(), cfg.Vault.RetainFor())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entraService, err := entra_oauth2.NewEntraService(cfg, secretProvider, backend, store.NewTokenVault(backend, keyring), store.NewCacheVault(backend, keyring))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	http.HandleFunc("/", entraService.HandleHome)
 	http.HandleFunc("/login", entraService.HandleLogin)
 	http.HandleFunc("/auth/callback", entraService.HandleCallback)
 	http.HandleFunc("/test/token", entraService.GetToken)
+	http.HandleFunc("/tenant/offboard", entraService.HandleOffboard)
+	http.HandleFunc("/templates", entraService.HandleTemplates)
+	http.HandleFunc("/tenant/certificates", entraService.HandleCertificates)
+	entraService.StartCertificateRotation(context.Background())
 
-	port := "8080"
+	port := cfg.Server.Port
 	log.Printf("Server running on http://localhost:%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
+
+func sealSecret(keyFile string) {
+	key, err := secrets.LoadKey(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plaintext, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sealed, err := secrets.Seal(key, bytes.TrimRight(plaintext, "\r\n"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(sealed)
+}
+
+func searchTemplates(args []string) {
+	fs := flag.NewFlagSet("templates", flag.ExitOnError)
+	token := fs.String("token", os.Getenv("IDP_GRAPH_TOKEN"), "graph access token")
+	cloudName := fs.String("cloud", config.CloudGlobal, "national cloud: global, usgov or china")
+	name := fs.String("name", "", "display name contains")
+	category := fs.String("category", "", "category")
+	ssoMode := fs.String("sso", "", "supported single sign-on mode (saml, oidc, password)")
+	provisioning := fs.Bool("provisioning", false, "only templates supporting provisioning")
+	limit := fs.Int("limit", 0, "most templates listed, 100 by default")
+	fs.Parse(args)
+	if *token == "" {
+		log.Fatal("-token or IDP_GRAPH_TOKEN is required")
+	}
+
+	cloud, err := entra_oauth2.LookupCloudEnvironment(*cloudName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	graphClient, err := entra_oauth2.NewCloudGraphServiceClient(cloud, &entra_oauth2.TokenCredential{
+		Token:     *token,
+		ExpiresOn: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	templates, err := entra_oauth2.SearchApplicationTemplates(context.Background(), graphClient, entra_oauth2.TemplateQuery{
+		Name:         *name,
+		Category:     *category,
+		SSOMode:      *ssoMode,
+		Provisioning: *provisioning,
+		Limit:        *limit,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tCATEGORIES\tSSO\tPROVISIONING")
+	for _, t := range templates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.DisplayName,
+			strings.Join(t.Categories, ","), strings.Join(t.SupportedSSOModes, ","), strings.Join(t.SupportedProvisioningTypes, ","))
+	}
+	w.Flush()
+}
@@ -0,0 +1,223 @@
+// Package metadata parses and validates SAML 2.0 federation metadata, as
+// published by Entra for a SAML application, before it is handed to UCS.
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed            = errors.New("metadata: malformed")
+	ErrNoSigningCertificate = errors.New("metadata: no signing certificate")
+	ErrCertificateExpired   = errors.New("metadata: signing certificate expired")
+	ErrExpired              = errors.New("metadata: validUntil passed")
+	ErrUnsigned             = errors.New("metadata: not signed")
+	ErrSignatureInvalid     = errors.New("metadata: signature invalid")
+	ErrEntityIDMismatch     = errors.New("metadata: entity id mismatch")
+	ErrCertificateMismatch  = errors.New("metadata: signing certificate mismatch")
+)
+
+// Endpoint is a SingleSignOnService or SingleLogoutService.
+type Endpoint struct {
+	Binding  string `xml:"Binding,attr" json:"binding"`
+	Location string `xml:"Location,attr" json:"location"`
+}
+
+// Metadata is the identity provider part of an EntityDescriptor.
+type Metadata struct {
+	EntityID   string
+	ValidUntil time.Time
+
+	SigningCertificates []*x509.Certificate
+	SSOEndpoints        []Endpoint
+	SLOEndpoints        []Endpoint
+
+	// has an enveloped signature, see Verify
+	Signed bool
+
+	raw []byte
+}
+
+type entityDescriptor struct {
+	XMLName    xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID   string    `xml:"entityID,attr"`
+	ValidUntil string    `xml:"validUntil,attr"`
+	Signature  *struct{} `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	IDPSSO     []struct {
+		Keys []struct {
+			Use  string `xml:"use,attr"`
+			Cert string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []Endpoint `xml:"SingleSignOnService"`
+		SLO []Endpoint `xml:"SingleLogoutService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// Parse reads an EntityDescriptor with an IDPSSODescriptor.
+func Parse(data []byte) (*Metadata, error) {
+	var ed entityDescriptor
+	if err := xml.Unmarshal(data, &ed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if ed.EntityID == "" {
+		return nil, fmt.Errorf("%w: entityID missing", ErrMalformed)
+	}
+	if len(ed.IDPSSO) == 0 {
+		return nil, fmt.Errorf("%w: IDPSSODescriptor missing", ErrMalformed)
+	}
+
+	m := &Metadata{EntityID: ed.EntityID, Signed: ed.Signature != nil, raw: data}
+	if ed.ValidUntil != "" {
+		validUntil, err := time.Parse(time.RFC3339, ed.ValidUntil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: validUntil %q", ErrMalformed, ed.ValidUntil)
+		}
+		m.ValidUntil = validUntil
+	}
+	for _, idp := range ed.IDPSSO {
+		for _, key := range idp.Keys {
+			if key.Use != "" && key.Use != "signing" {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(key.Cert), ""))
+			if err != nil {
+				return nil, fmt.Errorf("%w: signing certificate: %v", ErrMalformed, err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("%w: signing certificate: %v", ErrMalformed, err)
+			}
+			if !containsCert(m.SigningCertificates, cert) {
+				m.SigningCertificates = append(m.SigningCertificates, cert)
+			}
+		}
+		m.SSOEndpoints = append(m.SSOEndpoints, idp.SSO...)
+		m.SLOEndpoints = append(m.SLOEndpoints, idp.SLO...)
+	}
+	if len(m.SSOEndpoints) == 0 {
+		return nil, fmt.Errorf("%w: SingleSignOnService missing", ErrMalformed)
+	}
+	return m, nil
+}
+
+// Expectations describe the metadata the caller asked for.
+type Expectations struct {
+	// expected entityID, empty to skip
+	EntityID string
+
+	// sha1 thumbprint (hex) of the signing certificate of the application the
+	// metadata was requested for, metadata of another application is rejected
+	SigningThumbprint string
+
+	// certificates trusted to sign the metadata, by default the signing
+	// certificate matching SigningThumbprint, or every signing certificate
+	TrustedCerts []*x509.Certificate
+
+	// reject unsigned metadata
+	RequireSignature bool
+
+	// validation time, now when zero
+	Now time.Time
+}
+
+// Validate checks expiry, the expected entity id and signing certificate, and
+// the signature. Every failed check is reported.
+func (m *Metadata) Validate(exp Expectations) error {
+	now := exp.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var errs []error
+	if !m.ValidUntil.IsZero() && now.After(m.ValidUntil) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrExpired, m.ValidUntil.Format(time.RFC3339)))
+	}
+	if exp.EntityID != "" && m.EntityID != exp.EntityID {
+		errs = append(errs, fmt.Errorf("%w: got %s, want %s", ErrEntityIDMismatch, m.EntityID, exp.EntityID))
+	}
+
+	if len(m.SigningCertificates) == 0 {
+		errs = append(errs, ErrNoSigningCertificate)
+	}
+	for _, cert := range m.SigningCertificates {
+		if now.After(cert.NotAfter) {
+			errs = append(errs, fmt.Errorf("%w: %s expired %s", ErrCertificateExpired, Thumbprint(cert), cert.NotAfter.Format(time.RFC3339)))
+		}
+	}
+
+	trusted := exp.TrustedCerts
+	if exp.SigningThumbprint != "" {
+		cert := m.Certificate(exp.SigningThumbprint)
+		if cert == nil {
+			errs = append(errs, fmt.Errorf("%w: %s not found", ErrCertificateMismatch, exp.SigningThumbprint))
+		} else if len(trusted) == 0 {
+			trusted = []*x509.Certificate{cert}
+		}
+	}
+	if len(trusted) == 0 {
+		trusted = m.SigningCertificates
+	}
+
+	switch {
+	case m.Signed && len(trusted) > 0:
+		if err := Verify(m.raw, trusted, now); err != nil {
+			errs = append(errs, err)
+		}
+	case !m.Signed && exp.RequireSignature:
+		errs = append(errs, ErrUnsigned)
+	}
+	return errors.Join(errs...)
+}
+
+// Certificate returns the signing certificate with the thumbprint, or nil.
+func (m *Metadata) Certificate(thumbprint string) *x509.Certificate {
+	for _, cert := range m.SigningCertificates {
+		if strings.EqualFold(Thumbprint(cert), thumbprint) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Verify checks the enveloped signature of the document against the trusted certificates.
+func Verify(data []byte, trusted []*x509.Certificate, now time.Time) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if doc.Root() == nil {
+		return fmt.Errorf("%w: empty document", ErrMalformed)
+	}
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: trusted})
+	ctx.Clock = dsig.NewFakeClockAt(now)
+	if _, err := ctx.Validate(doc.Root()); err != nil {
+		return fmt.Errorf("%w: %v", ErrSignatureInvalid, err)
+	}
+	return nil
+}
+
+// Thumbprint returns the upper case hex sha1 thumbprint Entra uses for certificates.
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
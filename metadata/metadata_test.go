@@ -0,0 +1,202 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	// the fixture is downloaded from /common, so the entity id keeps the placeholder
+	fixtureEntityID = "https://sts.windows.net/{tenantid}/"
+
+	// the certificate the fixture is signed with
+	signerThumbprint = "FE33708DE4A7BD34CAF1711DAF94143E40512CBA"
+
+	// another signing certificate listed in the fixture
+	otherThumbprint = "08DBF4388DD1C2A9471445676A8300B21087D971"
+)
+
+var fixtureNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/federationmetadata.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// unsigned removes the enveloped signature of the document
+func unsigned(t *testing.T, data []byte) []byte {
+	t.Helper()
+	start := bytes.Index(data, []byte("<Signature "))
+	end := bytes.Index(data, []byte("</Signature>"))
+	if start < 0 || end < 0 {
+		t.Fatal("fixture has no signature")
+	}
+	return append(append([]byte{}, data[:start]...), data[end+len("</Signature>"):]...)
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse(readFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.EntityID != fixtureEntityID {
+		t.Errorf("EntityID = %s, want %s", m.EntityID, fixtureEntityID)
+	}
+	if !m.Signed {
+		t.Error("Signed = false, want true")
+	}
+	if len(m.SigningCertificates) != 5 {
+		t.Errorf("got %d signing certificates, want 5", len(m.SigningCertificates))
+	}
+	if len(m.SSOEndpoints) == 0 {
+		t.Error("no SingleSignOnService endpoints")
+	}
+	if m.Certificate(signerThumbprint) == nil {
+		t.Errorf("Certificate(%s) = nil", signerThumbprint)
+	}
+	if m.Certificate("fe33708de4a7bd34caf1711daf94143e40512cba") == nil {
+		t.Error("Certificate is case sensitive")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not xml", "not xml"},
+		{"another root", `<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol"/>`},
+		{"entity id missing", `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"><IDPSSODescriptor/></EntityDescriptor>`},
+		{"idp descriptor missing", `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`},
+		{"sso endpoint missing", `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"><IDPSSODescriptor/></EntityDescriptor>`},
+		{"certificate not base64", `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"><IDPSSODescriptor>` +
+			`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>%%%</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+			`</IDPSSODescriptor></EntityDescriptor>`},
+		{"invalid validUntil", `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x" validUntil="tomorrow"><IDPSSODescriptor/></EntityDescriptor>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.data)); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Parse error = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fixture := readFixture(t)
+	tests := []struct {
+		name    string
+		data    []byte
+		exp     Expectations
+		wantErr error
+	}{
+		{
+			name: "valid",
+			data: fixture,
+			exp:  Expectations{EntityID: fixtureEntityID, SigningThumbprint: signerThumbprint, RequireSignature: true, Now: fixtureNow},
+		},
+		{
+			name: "any listed certificate trusted by default",
+			data: fixture,
+			exp:  Expectations{RequireSignature: true, Now: fixtureNow},
+		},
+		{
+			name:    "wrong issuer",
+			data:    fixture,
+			exp:     Expectations{EntityID: "https://sts.windows.net/00000000-0000-0000-0000-000000000000/", Now: fixtureNow},
+			wantErr: ErrEntityIDMismatch,
+		},
+		{
+			name:    "certificate of another application",
+			data:    fixture,
+			exp:     Expectations{SigningThumbprint: "0000000000000000000000000000000000000000", Now: fixtureNow},
+			wantErr: ErrCertificateMismatch,
+		},
+		{
+			name:    "signed by another certificate",
+			data:    fixture,
+			exp:     Expectations{SigningThumbprint: otherThumbprint, Now: fixtureNow},
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "certificate expired",
+			data:    fixture,
+			exp:     Expectations{SigningThumbprint: signerThumbprint, Now: time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)},
+			wantErr: ErrCertificateExpired,
+		},
+		{
+			name:    "unsigned rejected",
+			data:    unsigned(t, fixture),
+			exp:     Expectations{SigningThumbprint: signerThumbprint, RequireSignature: true, Now: fixtureNow},
+			wantErr: ErrUnsigned,
+		},
+		{
+			name: "unsigned allowed",
+			data: unsigned(t, fixture),
+			exp:  Expectations{SigningThumbprint: signerThumbprint, Now: fixtureNow},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.Validate(tt.exp)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	fixture := readFixture(t)
+	m, err := Parse(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := m.SigningCertificates
+	if err := Verify(fixture, trusted, fixtureNow); err != nil {
+		t.Fatalf("Verify fixture: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"sso endpoint redirected", "https://login.microsoftonline.com/common/saml2", "https://attacker.example.com/saml2"},
+		{"entity id replaced", fixtureEntityID, "https://sts.windows.net/00000000-0000-0000-0000-000000000000/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := bytes.Replace(fixture, []byte(tt.old), []byte(tt.new), 1)
+			if bytes.Equal(tampered, fixture) {
+				t.Fatalf("fixture does not contain %s", tt.old)
+			}
+			if err := Verify(tampered, trusted, fixtureNow); !errors.Is(err, ErrSignatureInvalid) {
+				t.Errorf("Verify error = %v, want ErrSignatureInvalid", err)
+			}
+
+			// a tampered document also fails Validate although every other check passes
+			m, err := Parse(tampered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Validate(Expectations{SigningThumbprint: signerThumbprint, Now: fixtureNow}); !errors.Is(err, ErrSignatureInvalid) {
+				t.Errorf("Validate error = %v, want ErrSignatureInvalid", err)
+			}
+		})
+	}
+}
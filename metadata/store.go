@@ -0,0 +1,286 @@
+package metadata
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("metadata: not found")
+
+// Revision is one stored version of the metadata of an application.
+type Revision struct {
+	// hex sha256 of the metadata document
+	Digest   string    `json:"digest"`
+	Size     int       `json:"size"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// Store keeps the federation metadata per tenant and application. Documents are
+// addressed by their content digest, storing an unchanged document again does
+// not add a revision.
+type Store interface {
+	// Put stores data as the latest revision of the application
+	Put(ctx context.Context, tenantID, appID string, data []byte) (Revision, error)
+
+	// Latest returns ErrNotFound if nothing was stored for the application
+	Latest(ctx context.Context, tenantID, appID string) (Revision, []byte, error)
+
+	// Get returns the document of a revision
+	Get(ctx context.Context, tenantID, appID, digest string) ([]byte, error)
+
+	// History returns the revisions of the application, newest first
+	History(ctx context.Context, tenantID, appID string) ([]Revision, error)
+}
+
+// NewStore returns a FileStore rooted at dir, or a MemoryStore when dir is empty.
+func NewStore(dir string) (Store, error) {
+	if dir == "" {
+		return NewMemoryStore(), nil
+	}
+	return NewFileStore(dir)
+}
+
+// Digest returns the content address of data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkKey rejects ids that would escape the store directory
+func checkKey(tenantID, appID string) error {
+	for _, id := range []string{tenantID, appID} {
+		if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+			return fmt.Errorf("metadata: invalid store key %q", id)
+		}
+	}
+	return nil
+}
+
+// MemoryStore keeps the metadata in process, it is lost on restart and not shared between replicas.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	revisions map[string][]Revision
+	documents map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{revisions: map[string][]Revision{}, documents: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, tenantID, appID string, data []byte) (Revision, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return Revision{}, err
+	}
+	key := tenantID + "/" + appID
+	rev := Revision{Digest: Digest(data), Size: len(data), StoredAt: time.Now().UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revisions := s.revisions[key]
+	if n := len(revisions); n > 0 && revisions[n-1].Digest == rev.Digest {
+		return revisions[n-1], nil
+	}
+	s.documents[key+"/"+rev.Digest] = append([]byte(nil), data...)
+	s.revisions[key] = append(revisions, rev)
+	return rev, nil
+}
+
+func (s *MemoryStore) Latest(ctx context.Context, tenantID, appID string) (Revision, []byte, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return Revision{}, nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := tenantID + "/" + appID
+	revisions := s.revisions[key]
+	if len(revisions) == 0 {
+		return Revision{}, nil, ErrNotFound
+	}
+	rev := revisions[len(revisions)-1]
+	return rev, s.documents[key+"/"+rev.Digest], nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, tenantID, appID, digest string) ([]byte, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, exist := s.documents[tenantID+"/"+appID+"/"+digest]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *MemoryStore) History(ctx context.Context, tenantID, appID string) ([]Revision, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return newestFirst(s.revisions[tenantID+"/"+appID]), nil
+}
+
+// FileStore persists the metadata as <dir>/<tenant>/<app>/<digest>.xml, the
+// revisions are appended to a history file next to the documents.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+const historyFile = "history"
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("metadata: create store directory %s: %w", dir, err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) appDir(tenantID, appID string) string {
+	return filepath.Join(s.dir, tenantID, appID)
+}
+
+func (s *FileStore) Put(ctx context.Context, tenantID, appID string, data []byte) (Revision, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return Revision{}, err
+	}
+	rev := Revision{Digest: Digest(data), Size: len(data), StoredAt: time.Now().UTC()}
+	dir := s.appDir(tenantID, appID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revisions, err := s.readHistory(dir)
+	if err != nil {
+		return Revision{}, err
+	}
+	if n := len(revisions); n > 0 && revisions[n-1].Digest == rev.Digest {
+		return revisions[n-1], nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Revision{}, fmt.Errorf("metadata: create %s: %w", dir, err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, rev.Digest+".xml"), data); err != nil {
+		return Revision{}, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return Revision{}, err
+	}
+	_, err = fmt.Fprintf(f, "%s %s %d\n", rev.StoredAt.Format(time.RFC3339Nano), rev.Digest, rev.Size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Revision{}, fmt.Errorf("metadata: append history: %w", err)
+	}
+	return rev, nil
+}
+
+func (s *FileStore) Latest(ctx context.Context, tenantID, appID string) (Revision, []byte, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return Revision{}, nil, err
+	}
+	s.mu.Lock()
+	revisions, err := s.readHistory(s.appDir(tenantID, appID))
+	s.mu.Unlock()
+	if err != nil {
+		return Revision{}, nil, err
+	}
+	if len(revisions) == 0 {
+		return Revision{}, nil, ErrNotFound
+	}
+	rev := revisions[len(revisions)-1]
+	data, err := s.Get(ctx, tenantID, appID, rev.Digest)
+	return rev, data, err
+}
+
+func (s *FileStore) Get(ctx context.Context, tenantID, appID, digest string) ([]byte, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return nil, err
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(s.appDir(tenantID, appID), digest+".xml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *FileStore) History(ctx context.Context, tenantID, appID string) ([]Revision, error) {
+	if err := checkKey(tenantID, appID); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revisions, err := s.readHistory(s.appDir(tenantID, appID))
+	if err != nil {
+		return nil, err
+	}
+	return newestFirst(revisions), nil
+}
+
+// readHistory returns the revisions oldest first, none if the application has no history yet
+func (s *FileStore) readHistory(dir string) ([]Revision, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var revisions []Revision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rev Revision
+		var storedAt string
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %s %d", &storedAt, &rev.Digest, &rev.Size); err != nil {
+			return nil, fmt.Errorf("metadata: corrupt history %s: %w", dir, err)
+		}
+		rev.StoredAt, err = time.Parse(time.RFC3339Nano, storedAt)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: corrupt history %s: %w", dir, err)
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, scanner.Err()
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a partial document
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newestFirst(revisions []Revision) []Revision {
+	out := make([]Revision, len(revisions))
+	for i, rev := range revisions {
+		out[len(revisions)-1-i] = rev
+	}
+	return out
+}
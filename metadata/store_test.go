@@ -0,0 +1,217 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stores returns each Store implementation, the file store rooted in a temporary directory
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(), "file": fileStore}
+}
+
+func TestStoreDedupe(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, err := s.Put(ctx, "tenant", "app", []byte("<v1/>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := s.Put(ctx, "tenant", "app", []byte("<v1/>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != first {
+				t.Errorf("Put of an unchanged document = %+v, want the stored revision %+v", again, first)
+			}
+			history, err := s.History(ctx, "tenant", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 {
+				t.Fatalf("History has %d revisions, want 1", len(history))
+			}
+
+			// only the latest revision is compared, going back to an earlier document is a change
+			if _, err := s.Put(ctx, "tenant", "app", []byte("<v2/>")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Put(ctx, "tenant", "app", []byte("<v1/>")); err != nil {
+				t.Fatal(err)
+			}
+			history, err = s.History(ctx, "tenant", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 3 {
+				t.Errorf("History has %d revisions, want 3", len(history))
+			}
+		})
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	ctx := context.Background()
+	documents := []string{"<v1/>", "<v2/>", "<v3/>"}
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := s.Latest(ctx, "tenant", "app"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Latest of an empty store: %v, want ErrNotFound", err)
+			}
+			for _, doc := range documents {
+				if _, err := s.Put(ctx, "tenant", "app", []byte(doc)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// another application of the tenant has its own history
+			if _, err := s.Put(ctx, "tenant", "other", []byte("<other/>")); err != nil {
+				t.Fatal(err)
+			}
+
+			history, err := s.History(ctx, "tenant", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != len(documents) {
+				t.Fatalf("History has %d revisions, want %d", len(history), len(documents))
+			}
+			for i, rev := range history {
+				want := documents[len(documents)-1-i]
+				if rev.Digest != Digest([]byte(want)) || rev.Size != len(want) {
+					t.Errorf("History[%d] = %+v, want %s (newest first)", i, rev, want)
+				}
+				if i > 0 && rev.StoredAt.After(history[i-1].StoredAt) {
+					t.Errorf("History[%d] stored after History[%d]", i, i-1)
+				}
+				data, err := s.Get(ctx, "tenant", "app", rev.Digest)
+				if err != nil || string(data) != want {
+					t.Errorf("Get(%s) = %q, %v; want %q", rev.Digest, data, err, want)
+				}
+			}
+
+			rev, data, err := s.Latest(ctx, "tenant", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != history[0] || string(data) != "<v3/>" {
+				t.Errorf("Latest = %+v %q, want %+v <v3/>", rev, data, history[0])
+			}
+			if _, err := s.Get(ctx, "tenant", "app", Digest([]byte("<missing/>"))); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of an unknown digest: %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "document.xml")
+	if err := os.WriteFile(path, []byte("<old/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("<new/>")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "<new/>" {
+		t.Errorf("document = %q, want <new/>", data)
+	}
+
+	// the temporary file is created next to the target, so the rename never crosses filesystems
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "document.xml"), []byte("<new/>")); err == nil {
+		t.Error("write into a missing directory succeeded")
+	}
+
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(context.Background(), "tenant", "app", []byte("<v1/>")); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), ".tmp-") {
+			t.Errorf("temporary file %s left behind", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreCorruptHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "tenant", "app", []byte("<v1/>")); err != nil {
+		t.Fatal(err)
+	}
+	history := filepath.Join(dir, "tenant", "app", historyFile)
+	f, err := os.OpenFile(history, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not a revision\n")
+	f.Close()
+
+	if _, _, err := s.Latest(ctx, "tenant", "app"); err == nil || !strings.Contains(err.Error(), "corrupt history") {
+		t.Errorf("Latest error = %v, want corrupt history", err)
+	}
+	if _, err := s.History(ctx, "tenant", "app"); err == nil || !strings.Contains(err.Error(), "corrupt history") {
+		t.Errorf("History error = %v, want corrupt history", err)
+	}
+	if _, err := s.Put(ctx, "tenant", "app", []byte("<v2/>")); err == nil || !strings.Contains(err.Error(), "corrupt history") {
+		t.Errorf("Put error = %v, want corrupt history", err)
+	}
+}
+
+func TestStoreRejectsInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		tenantID string
+		appID    string
+	}{
+		{name: "empty tenant", tenantID: "", appID: "app"},
+		{name: "empty app", tenantID: "tenant", appID: ""},
+		{name: "dot", tenantID: ".", appID: "app"},
+		{name: "parent tenant", tenantID: "..", appID: "app"},
+		{name: "parent app", tenantID: "tenant", appID: ".."},
+		{name: "slash", tenantID: "tenant", appID: "../../etc"},
+		{name: "backslash", tenantID: `..\tenant`, appID: "app"},
+	}
+	for name, s := range stores(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				if _, err := s.Put(ctx, tt.tenantID, tt.appID, []byte("<v1/>")); err == nil {
+					t.Error("Put accepted the key")
+				}
+				if _, _, err := s.Latest(ctx, tt.tenantID, tt.appID); err == nil || errors.Is(err, ErrNotFound) {
+					t.Errorf("Latest error = %v, want an invalid key", err)
+				}
+				if _, err := s.Get(ctx, tt.tenantID, tt.appID, Digest([]byte("<v1/>"))); err == nil || errors.Is(err, ErrNotFound) {
+					t.Errorf("Get error = %v, want an invalid key", err)
+				}
+				if _, err := s.History(ctx, tt.tenantID, tt.appID); err == nil {
+					t.Error("History accepted the key")
+				}
+			})
+		}
+	}
+	if err := checkKey("11111111-2222-3333-4444-555555555555", "app-client-id"); err != nil {
+		t.Errorf("checkKey rejected valid ids: %v", err)
+	}
+}
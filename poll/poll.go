@@ -0,0 +1,172 @@
+// Package poll waits for eventually consistent resources with exponential
+// backoff, jitter and a deadline, reporting progress as structured events.
+package poll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrTimeout is returned when the deadline passes before every probe is ready.
+var ErrTimeout = errors.New("poll: timed out")
+
+// Probe checks one readiness condition. A nil error with ready false, or a
+// non-permanent error, is retried on the next attempt.
+type Probe struct {
+	Name  string
+	Check func(ctx context.Context) (ready bool, err error)
+}
+
+// All combines probes into one that is ready once each of them is, checking them
+// in order and stopping at the first that is not.
+func All(name string, probes ...Probe) Probe {
+	return Probe{Name: name, Check: func(ctx context.Context) (bool, error) {
+		for _, p := range probes {
+			ready, err := p.Check(ctx)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", p.Name, err)
+			}
+			if !ready {
+				return false, &notReadyError{probe: p.Name}
+			}
+		}
+		return true, nil
+	}}
+}
+
+// notReadyError names the probe of a composite that is not ready yet.
+type notReadyError struct{ probe string }
+
+func (e *notReadyError) Error() string { return e.probe + " not ready" }
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a probe error as not worth retrying, Wait returns it at once.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Event reports the outcome of one attempt.
+type Event struct {
+	Probe   string
+	Attempt int
+	Elapsed time.Duration
+	Ready   bool
+
+	// probe of a composite that is not ready yet, empty for a single probe
+	Pending string
+
+	// probe error, nil when the probe was simply not ready yet
+	Err error
+
+	// delay before the next attempt, zero once ready or failed
+	NextDelay time.Duration
+}
+
+// Poller holds the backoff policy. The zero value polls every second with no
+// deadline besides the context's.
+type Poller struct {
+	// delay before the second attempt, the first runs immediately
+	InitialInterval time.Duration
+
+	// upper bound of the delay between attempts
+	MaxInterval time.Duration
+
+	// growth factor of the delay, 2 when unset
+	Multiplier float64
+
+	// fraction of the delay randomized in both directions, e.g. 0.2 for ±20%
+	Jitter float64
+
+	// overall deadline, zero to rely on the context
+	Timeout time.Duration
+
+	// called after every attempt
+	OnEvent func(Event)
+}
+
+// Wait runs the probe until it is ready, it fails permanently or the deadline passes.
+func (p Poller) Wait(ctx context.Context, probe Probe) error {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	delay := p.InitialInterval
+	if delay <= 0 {
+		delay = time.Second
+	}
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		ready, err := probe.Check(ctx)
+		event := Event{Probe: probe.Name, Attempt: attempt, Elapsed: time.Since(start), Ready: ready && err == nil}
+		var notReady *notReadyError
+		if errors.As(err, &notReady) {
+			event.Pending = notReady.probe
+		} else if err != nil {
+			event.Err = err
+			lastErr = err
+		}
+
+		var permanent *permanentError
+		if event.Ready || errors.As(err, &permanent) {
+			p.emit(event)
+			if permanent != nil {
+				return permanent.err
+			}
+			return nil
+		}
+
+		wait := p.jitter(delay)
+		event.NextDelay = wait
+		p.emit(event)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if lastErr != nil {
+				return fmt.Errorf("%w waiting for %s after %v: %w", ErrTimeout, probe.Name, time.Since(start).Round(time.Second), lastErr)
+			}
+			return fmt.Errorf("%w waiting for %s after %v", ErrTimeout, probe.Name, time.Since(start).Round(time.Second))
+		case <-timer.C:
+		}
+		delay = p.next(delay)
+	}
+}
+
+func (p Poller) next(delay time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay = time.Duration(float64(delay) * multiplier)
+	if p.MaxInterval > 0 && delay > p.MaxInterval {
+		delay = p.MaxInterval
+	}
+	return delay
+}
+
+func (p Poller) jitter(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+func (p Poller) emit(event Event) {
+	if p.OnEvent != nil {
+		p.OnEvent(event)
+	}
+}
@@ -0,0 +1,178 @@
+package poll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// readyAfter returns a probe that becomes ready on the given attempt, counting
+// its calls in *calls.
+func readyAfter(attempt int, calls *int) Probe {
+	return Probe{Name: "probe", Check: func(ctx context.Context) (bool, error) {
+		*calls++
+		return *calls >= attempt, nil
+	}}
+}
+
+func TestWait(t *testing.T) {
+	errGone := errors.New("gone")
+	errFlaky := errors.New("flaky")
+	tests := []struct {
+		name      string
+		poller    Poller
+		probe     func(calls *int) Probe
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "ready at once",
+			poller:    Poller{InitialInterval: time.Millisecond},
+			probe:     func(calls *int) Probe { return readyAfter(1, calls) },
+			wantCalls: 1,
+		},
+		{
+			name:      "ready after retries",
+			poller:    Poller{InitialInterval: time.Millisecond},
+			probe:     func(calls *int) Probe { return readyAfter(3, calls) },
+			wantCalls: 3,
+		},
+		{
+			name:   "transient errors are retried",
+			poller: Poller{InitialInterval: time.Millisecond},
+			probe: func(calls *int) Probe {
+				return Probe{Name: "probe", Check: func(ctx context.Context) (bool, error) {
+					*calls++
+					if *calls < 3 {
+						return false, errFlaky
+					}
+					return true, nil
+				}}
+			},
+			wantCalls: 3,
+		},
+		{
+			name:   "permanent error stops at once",
+			poller: Poller{InitialInterval: time.Millisecond},
+			probe: func(calls *int) Probe {
+				return Probe{Name: "probe", Check: func(ctx context.Context) (bool, error) {
+					*calls++
+					return false, Permanent(errGone)
+				}}
+			},
+			wantErr:   errGone,
+			wantCalls: 1,
+		},
+		{
+			name:    "timeout",
+			poller:  Poller{InitialInterval: 10 * time.Millisecond, Timeout: 35 * time.Millisecond},
+			probe:   func(calls *int) Probe { return readyAfter(1000, calls) },
+			wantErr: ErrTimeout,
+		},
+		{
+			name:   "timeout wraps the last probe error",
+			poller: Poller{InitialInterval: 10 * time.Millisecond, Timeout: 35 * time.Millisecond},
+			probe: func(calls *int) Probe {
+				return Probe{Name: "probe", Check: func(ctx context.Context) (bool, error) {
+					*calls++
+					return false, errFlaky
+				}}
+			},
+			wantErr: errFlaky,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := tt.poller.Wait(context.Background(), tt.probe(&calls))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Wait error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantCalls > 0 && calls != tt.wantCalls {
+				t.Errorf("probe called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWaitContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := Poller{InitialInterval: time.Hour}.Wait(ctx, readyAfter(2, &calls))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Wait error = %v, want ErrTimeout", err)
+	}
+	if calls != 1 {
+		t.Errorf("probe called %d times, want 1", calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		poller Poller
+		want   []time.Duration
+	}{
+		{
+			name:   "default multiplier",
+			poller: Poller{InitialInterval: time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "capped",
+			poller: Poller{InitialInterval: time.Second, Multiplier: 3, MaxInterval: 5 * time.Second},
+			want:   []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := tt.poller.InitialInterval
+			for i, want := range tt.want {
+				if delay != want {
+					t.Errorf("delay %d = %v, want %v", i, delay, want)
+				}
+				delay = tt.poller.next(delay)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	p := Poller{Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d := p.jitter(time.Second); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("jitter(1s) = %v, want within ±20%%", d)
+		}
+	}
+	if d := (Poller{}).jitter(time.Second); d != time.Second {
+		t.Errorf("jitter without Jitter = %v, want 1s", d)
+	}
+}
+
+func TestAllEvents(t *testing.T) {
+	appCalls, spCalls := 0, 0
+	probe := All("application",
+		Probe{Name: "app", Check: func(ctx context.Context) (bool, error) { appCalls++; return true, nil }},
+		Probe{Name: "sp", Check: func(ctx context.Context) (bool, error) { spCalls++; return spCalls >= 2, nil }},
+	)
+
+	var events []Event
+	p := Poller{InitialInterval: time.Millisecond, OnEvent: func(e Event) { events = append(events, e) }}
+	if err := p.Wait(context.Background(), probe); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if first := events[0]; first.Ready || first.Pending != "sp" || first.Err != nil || first.NextDelay == 0 {
+		t.Errorf("first event = %+v, want sp pending with a next delay", first)
+	}
+	if last := events[1]; !last.Ready || last.Attempt != 2 || last.NextDelay != 0 {
+		t.Errorf("last event = %+v, want ready on attempt 2", last)
+	}
+	if appCalls != 2 {
+		t.Errorf("app probe called %d times, want 2", appCalls)
+	}
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"os"
+	"strings"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+// EncryptedFileProvider reads secret "entra_client_secret" from
+// <Dir>/entra_client_secret.enc, sealed with NaCl secretbox under a keyfile.
+// The file holds base64(nonce || box) as produced by Seal.
+type EncryptedFileProvider struct {
+	Dir string
+	key *[keySize]byte
+}
+
+func NewEncryptedFileProvider(dir, keyFile string) (*EncryptedFileProvider, error) {
+	key, err := LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFileProvider{Dir: dir, key: key}, nil
+}
+
+func (p *EncryptedFileProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	data, err := readSecretFile(p.Dir, name+".enc")
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := Open(p.key, data)
+	if err != nil {
+		return "", fmt.Errorf("secrets: decrypt %s: %w", name, err)
+	}
+	return string(plaintext), nil
+}
+
+// LoadKey reads a 32 byte key stored raw, hex or base64 encoded.
+func LoadKey(keyFile string) (*[keySize]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: read key file: %w", err)
+	}
+	raw := data
+	if len(raw) != keySize {
+		text := strings.TrimSpace(string(data))
+		if decoded, err := hex.DecodeString(text); err == nil {
+			raw = decoded
+		} else if decoded, err := base64.StdEncoding.DecodeString(text); err == nil {
+			raw = decoded
+		}
+	}
+	if len(raw) != keySize {
+		return nil, fmt.Errorf("secrets: key file must hold %d bytes, got %d", keySize, len(raw))
+	}
+	key := new([keySize]byte)
+	copy(key[:], raw)
+	return key, nil
+}
+
+// Seal encrypts plaintext into the format read by EncryptedFileProvider.
+func Seal(key *[keySize]byte, plaintext []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	box := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+	return []byte(base64.StdEncoding.EncodeToString(box)), nil
+}
+
+// Open decrypts data produced by Seal.
+func Open(key *[keySize]byte, data []byte) ([]byte, error) {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("ciphertext too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], box[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, box[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("authentication failed")
+	}
+	return plaintext, nil
+}
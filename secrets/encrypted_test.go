@@ -0,0 +1,142 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) *[keySize]byte {
+	key := new([keySize]byte)
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testKey(1)
+	sealed, err := Seal(key, []byte("client-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Seal(key, []byte("client-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice produced the same box, nonce is not random")
+	}
+
+	plaintext, err := Open(key, append(sealed, '\n'))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if string(plaintext) != "client-secret" {
+		t.Errorf("Open = %q, want %q", plaintext, "client-secret")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	key := testKey(1)
+	sealed, err := Seal(key, []byte("client-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, _ := base64.StdEncoding.DecodeString(string(sealed))
+	box[len(box)-1] ^= 0xff
+	tampered := []byte(base64.StdEncoding.EncodeToString(box))
+
+	tests := []struct {
+		name string
+		key  *[keySize]byte
+		data []byte
+	}{
+		{"wrong key", testKey(2), sealed},
+		{"tampered box", key, tampered},
+		{"too short", key, []byte(base64.StdEncoding.EncodeToString([]byte("short")))},
+		{"not base64", key, []byte("!!!")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.key, tt.data); err == nil {
+				t.Error("Open succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLoadKeyEncodings(t *testing.T) {
+	key := testKey(7)
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"raw", key[:]},
+		{"hex", []byte(hex.EncodeToString(key[:]) + "\n")},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key[:]))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadKey(path)
+			if err != nil {
+				t.Fatalf("LoadKey: %v", err)
+			}
+			if *loaded != *key {
+				t.Error("LoadKey returned a different key")
+			}
+		})
+	}
+
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte("abcd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(short); err == nil {
+		t.Error("LoadKey accepted a short key")
+	}
+}
+
+func TestEncryptedFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "secrets.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(testKey(3)[:])), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Seal(testKey(3), []byte("scim-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scim_token_idp.enc"), sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewEncryptedFileProvider(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := provider.GetSecret(context.Background(), "scim_token_idp")
+	if err != nil {
+		t.Fatalf("GetSecret: %v", err)
+	}
+	if secret != "scim-token" {
+		t.Errorf("GetSecret = %q, want %q", secret, "scim-token")
+	}
+
+	if _, err := provider.GetSecret(context.Background(), "missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("GetSecret(missing) = %v, want ErrSecretNotFound", err)
+	}
+	if _, err := provider.GetSecret(context.Background(), "../secrets.key"); err == nil {
+		t.Error("GetSecret accepted a path outside the secrets directory")
+	}
+}
@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"idp-test-go/config"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider resolves a named secret at the point of use, so that client
+// secrets and scim tokens never need to be kept in config or in long-lived memory.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// New builds the provider selected by cfg.Provider.
+func New(cfg config.SecretsConfig) (SecretProvider, error) {
+	switch cfg.Provider {
+	case "", config.SecretProviderEnv:
+		return &EnvProvider{Prefix: cfg.EnvPrefix}, nil
+	case config.SecretProviderFile:
+		return &FileProvider{Dir: cfg.Dir}, nil
+	case config.SecretProviderEncrypted:
+		return NewEncryptedFileProvider(cfg.Dir, cfg.KeyFile)
+	default:
+		return nil, fmt.Errorf("secrets: unknown provider %q", cfg.Provider)
+	}
+}
+
+// EnvProvider reads secret "entra_client_secret" from env IDP_SECRET_ENTRA_CLIENT_SECRET.
+type EnvProvider struct {
+	Prefix string
+}
+
+func (p *EnvProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	key := p.envName(name)
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return "", fmt.Errorf("%w: env %s", ErrSecretNotFound, key)
+	}
+	return value, nil
+}
+
+func (p *EnvProvider) envName(name string) string {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = "IDP_SECRET_"
+	}
+	return prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// FileProvider reads secret "entra_client_secret" from <Dir>/entra_client_secret,
+// which is the layout of mounted kubernetes/docker secrets.
+type FileProvider struct {
+	Dir string
+}
+
+func (p *FileProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	data, err := readSecretFile(p.Dir, name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSecretFile(dir, name string) ([]byte, error) {
+	if name == "" || name != filepath.Base(name) {
+		return nil, fmt.Errorf("secrets: invalid secret name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secrets: read %s: %w", name, err)
+	}
+	return data, nil
+}
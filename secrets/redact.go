@@ -0,0 +1,11 @@
+package secrets
+
+import "fmt"
+
+// Redact hides a token or code for logging, keeping a short prefix to tell values apart.
+func Redact(value string) string {
+	if len(value) <= 8 {
+		return "***"
+	}
+	return fmt.Sprintf("%s***(%d)", value[:4], len(value))
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var boltBucket = []byte("kv")
+
+// BoltBackend persists entries in a single BoltDB file, it survives restarts
+// of a single replica. Every value is prefixed with its expiry in unix nanoseconds.
+type BoltBackend struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("store: open bolt %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	b := &BoltBackend{db: db, stop: make(chan struct{})}
+	go b.janitor(10 * time.Minute)
+	return b, nil
+}
+
+func (b *BoltBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	entry := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(expiresAt))
+	copy(entry[8:], value)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), entry)
+	})
+}
+
+func (b *BoltBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		value, err = boltValue(tx.Bucket(boltBucket).Get([]byte(key)))
+		return err
+	})
+	return value, err
+}
+
+func (b *BoltBackend) Take(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var err error
+		value, err = boltValue(bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(key))
+	})
+	return value, err
+}
+
+func (b *BoltBackend) Delete(ctx context.Context, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *BoltBackend) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	now := time.Now()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if len(v) >= 8 && !boltExpired(v, now) {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *BoltBackend) Close() error {
+	close(b.stop)
+	return b.db.Close()
+}
+
+// boltValue copies the value out of the transaction, expired entries are reported missing
+func boltValue(entry []byte) ([]byte, error) {
+	if len(entry) < 8 || boltExpired(entry, time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), entry[8:]...), nil
+}
+
+func boltExpired(entry []byte, now time.Time) bool {
+	expiresAt := int64(binary.BigEndian.Uint64(entry))
+	return expiresAt > 0 && now.UnixNano() > expiresAt
+}
+
+// janitor removes expired entries periodically
+func (b *BoltBackend) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			_ = b.db.Update(func(tx *bolt.Tx) error {
+				c := tx.Bucket(boltBucket).Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					if len(v) < 8 || boltExpired(v, now) {
+						if err := c.Delete(); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"idp-test-go/secrets"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// key ids are <creation time>-<random>, they sort by creation time and never
+// collide between replicas rotating at the same moment.
+const keyIDLayout = "20060102T150405.000000000Z"
+
+// Keyring holds the vault keys. The newest key seals, every retained key opens.
+// Keys rotate once the active key is older than the interval. A retired key is
+// dropped once every entry sealed with it has expired, entries live at most
+// retention. With a directory the keys are shared between replicas and survive
+// restarts, otherwise they live in memory only.
+type Keyring struct {
+	mu        sync.RWMutex
+	dir       string
+	interval  time.Duration
+	retention time.Duration
+	keys      map[string]*[32]byte
+	activeID  string
+}
+
+func NewKeyring(dir string, interval, retention time.Duration) (*Keyring, error) {
+	k := &Keyring{dir: dir, interval: interval, retention: retention, keys: make(map[string]*[32]byte)}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("store: create key dir: %w", err)
+		}
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+	}
+	if k.activeID == "" {
+		if err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *Keyring) load() error {
+	files, err := filepath.Glob(filepath.Join(k.dir, "*.key"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".key")
+		if _, ok := keyCreated(id); !ok {
+			continue
+		}
+		key, err := secrets.LoadKey(file)
+		if err != nil {
+			return err
+		}
+		k.keys[id] = key
+	}
+	k.activeID = k.newestID()
+	return nil
+}
+
+// Rotate makes a fresh key active
+func (k *Keyring) Rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rotate(time.Now())
+}
+
+func (k *Keyring) rotate(now time.Time) error {
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	id := now.UTC().Format(keyIDLayout) + "-" + hex.EncodeToString(suffix)
+	if k.dir != "" {
+		if err := writeKey(filepath.Join(k.dir, id+".key"), key); err != nil {
+			return fmt.Errorf("store: write vault key: %w", err)
+		}
+	}
+	k.keys[id] = key
+	k.activeID = id
+	k.prune(now)
+	return nil
+}
+
+// writeKey creates the key file, failing instead of overwriting an existing key
+func writeKey(path string, key *[32]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(hex.EncodeToString(key[:]))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// keyCreated returns the creation time encoded in a key id
+func keyCreated(id string) (time.Time, bool) {
+	stamp, _, _ := strings.Cut(id, "-")
+	created, err := time.Parse(keyIDLayout, stamp)
+	return created, err == nil
+}
+
+// prune drops keys that no stored entry can reference any more. A key seals
+// until its successor is created, plus up to one interval on replicas that have
+// not picked up the successor yet, and sealed entries expire after retention.
+func (k *Keyring) prune(now time.Time) {
+	if k.retention <= 0 {
+		return
+	}
+	ids := k.sortedIDs()
+	for i, id := range ids[:max(len(ids)-1, 0)] {
+		retired, _ := keyCreated(ids[i+1])
+		if id != k.activeID && now.Sub(retired) > k.retention+k.interval {
+			delete(k.keys, id)
+			if k.dir != "" {
+				_ = os.Remove(filepath.Join(k.dir, id+".key"))
+			}
+		}
+	}
+}
+
+// active returns the sealing key, rotating it first when it is due
+func (k *Keyring) active() (string, *[32]byte, error) {
+	now := time.Now()
+	k.mu.RLock()
+	id := k.activeID
+	created, _ := keyCreated(id)
+	due := k.interval > 0 && now.Sub(created) > k.interval
+	key := k.keys[id]
+	k.mu.RUnlock()
+	if !due {
+		return id, key, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.activeID == id {
+		if err := k.rotate(now); err != nil {
+			return "", nil, err
+		}
+	}
+	return k.activeID, k.keys[k.activeID], nil
+}
+
+// key returns the key with the given id, reloading the key dir once so that
+// keys rotated by another replica are picked up
+func (k *Keyring) key(id string) (*[32]byte, error) {
+	k.mu.RLock()
+	key, exist := k.keys[id]
+	k.mu.RUnlock()
+	if exist {
+		return key, nil
+	}
+	if k.dir != "" {
+		k.mu.Lock()
+		err := k.load()
+		key, exist = k.keys[id]
+		k.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !exist {
+		return nil, fmt.Errorf("store: vault key %s not found", id)
+	}
+	return key, nil
+}
+
+// Retention returns the longest lifetime of an entry sealed with the keyring
+func (k *Keyring) Retention() time.Duration {
+	return k.retention
+}
+
+func (k *Keyring) newestID() string {
+	ids := k.sortedIDs()
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// sortedIDs returns the key ids oldest first
+func (k *Keyring) sortedIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := keyCreated(ids[i])
+		b, _ := keyCreated(ids[j])
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyring, err := NewKeyring(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := NewTokenVault(NewMemoryBackend(), keyring)
+	if err := tokens.SaveToken(ctx, "before", &Token{AccessToken: "a", ExpiresOn: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	before, _, _ := keyring.active()
+
+	if err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	after, _, _ := keyring.active()
+	if after == before {
+		t.Fatalf("active key %s unchanged after Rotate", after)
+	}
+	if token, err := tokens.GetToken(ctx, "before"); err != nil || token.AccessToken != "a" {
+		t.Errorf("GetToken sealed with the retired key = %v, %v", token, err)
+	}
+
+	// a second replica sharing the key dir seals with the newest key and opens
+	// entries sealed by the first one
+	replica, err := NewKeyring(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := replica.active(); id != after {
+		t.Errorf("replica active key = %s, want %s", id, after)
+	}
+	if _, err := replica.key(before); err != nil {
+		t.Errorf("replica key(%s): %v", before, err)
+	}
+}
+
+func TestKeyringIDsDoNotCollide(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	first := &Keyring{dir: dir, keys: make(map[string]*[32]byte)}
+	second := &Keyring{dir: dir, keys: make(map[string]*[32]byte)}
+	if err := first.rotate(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.rotate(now); err != nil {
+		t.Fatalf("second replica rotating at the same time: %v", err)
+	}
+	if first.activeID == second.activeID {
+		t.Fatalf("both replicas created key %s", first.activeID)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("key dir holds %d keys, want 2", len(files))
+	}
+}
+
+func TestKeyringPrune(t *testing.T) {
+	const (
+		interval  = time.Hour
+		retention = 24 * time.Hour
+	)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// time of the last rotation, measured from the rotation retiring the
+		// oldest key
+		elapsed  time.Duration
+		wantKeys int
+	}{
+		{"within retention", retention, 3},
+		{"within retention plus interval", retention + interval, 3},
+		{"past retention plus interval", retention + interval + time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			k := &Keyring{dir: dir, interval: interval, retention: retention, keys: make(map[string]*[32]byte)}
+			for _, at := range []time.Time{start, start.Add(interval), start.Add(interval + tt.elapsed)} {
+				if err := k.rotate(at); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(k.keys) != tt.wantKeys {
+				t.Errorf("keyring holds %d keys, want %d", len(k.keys), tt.wantKeys)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "*.key"))
+			if len(files) != tt.wantKeys {
+				t.Errorf("key dir holds %d keys, want %d", len(files), tt.wantKeys)
+			}
+			if _, err := os.Stat(filepath.Join(dir, k.activeID+".key")); err != nil {
+				t.Errorf("active key pruned: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"github.com/patrickmn/go-cache"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps entries in process, it is lost on restart and not shared between replicas.
+type MemoryBackend struct {
+	// serializes writers so a Set or Delete cannot land between the Get and
+	// Delete of Take
+	mu    sync.Mutex
+	cache *cache.Cache
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{cache: cache.New(cache.NoExpiration, 10*time.Minute)}
+}
+
+func (b *MemoryBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cache.Set(key, value, ttl)
+	return nil
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	value, exist := b.cache.Get(key)
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return value.([]byte), nil
+}
+
+func (b *MemoryBackend) Take(ctx context.Context, key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value, exist := b.cache.Get(key)
+	if !exist {
+		return nil, ErrNotFound
+	}
+	b.cache.Delete(key)
+	return value.([]byte), nil
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cache.Delete(key)
+	return nil
+}
+
+func (b *MemoryBackend) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for key := range b.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
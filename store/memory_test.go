@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendTTL(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wait    time.Duration
+		wantErr error
+	}{
+		{"before expiry", time.Minute, 0, nil},
+		{"after expiry", 20 * time.Millisecond, 50 * time.Millisecond, ErrNotFound},
+		{"zero ttl never expires", 0, 50 * time.Millisecond, nil},
+		{"negative ttl never expires", -time.Second, 50 * time.Millisecond, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBackend()
+			if err := b.Set(ctx, "key", []byte("value"), tt.ttl); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+
+			value, err := b.Get(ctx, "key")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(value) != "value" {
+				t.Errorf("Get = %q, want %q", value, "value")
+			}
+			if _, err := b.Take(ctx, "key"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Take error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendTakeOnce(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	if err := b.Set(ctx, "state:abc", []byte("verifier"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.Take(ctx, "state:abc"); err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Errorf("state taken %d times, want once", taken)
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	tokens := NewTokenStore(NewMemoryBackend())
+
+	if err := tokens.SaveToken(ctx, "expired", &Token{AccessToken: "a", ExpiresOn: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.GetToken(ctx, "expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetToken(expired) error = %v, want ErrNotFound", err)
+	}
+
+	if err := tokens.SaveToken(ctx, "short", &Token{AccessToken: "b", ExpiresOn: time.Now().Add(20 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := tokens.GetToken(ctx, "short"); err != nil || token.AccessToken != "b" {
+		t.Fatalf("GetToken(short) = %v, %v", token, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := tokens.GetToken(ctx, "short"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetToken(short) after ExpiresOn error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryBackendKeys(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	for key, ttl := range map[string]time.Duration{
+		"workflow:a":       0,
+		"workflow:b":       time.Minute,
+		"workflow:expired": 20 * time.Millisecond,
+		"scim_token:a":     0,
+		"state:a":          0,
+	} {
+		if err := b.Set(ctx, key, []byte("v"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	keys, err := b.Keys(ctx, "workflow:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"workflow:a", "workflow:b"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys = %v, want %v", keys, want)
+	}
+}
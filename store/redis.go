@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"time"
+)
+
+// RedisBackend shares entries between replicas through any server speaking the redis protocol.
+type RedisBackend struct {
+	client *redis.Client
+}
+
+func NewRedisBackend(ctx context.Context, redisURL, password string) (*RedisBackend, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("store: parse redis url: %w", err)
+	}
+	if password != "" {
+		opts.Password = password
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("store: connect redis: %w", err)
+	}
+	return &RedisBackend{client: client}, nil
+}
+
+func (b *RedisBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return b.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (b *RedisBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	return redisValue(b.client.Get(ctx, key).Bytes())
+}
+
+func (b *RedisBackend) Take(ctx context.Context, key string) ([]byte, error) {
+	return redisValue(b.client.GetDel(ctx, key).Bytes())
+}
+
+func (b *RedisBackend) Delete(ctx context.Context, key string) error {
+	return b.client.Del(ctx, key).Err()
+}
+
+func (b *RedisBackend) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := b.client.Scan(ctx, 0, redisGlobEscaper.Replace(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// redisGlobEscaper escapes the glob metacharacters of a SCAN pattern
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
+
+func redisValue(value []byte, err error) ([]byte, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"idp-test-go/config"
+	"idp-test-go/secrets"
+	"time"
+)
+
+var ErrNotFound = errors.New("store: not found")
+
+// Backend is a concurrency-safe key/value store with per-key expiry. The typed
+// stores are built on top of it so that every handler shares one backend.
+type Backend interface {
+	// Set stores value under key, ttl <= 0 means no expiry
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Get returns ErrNotFound if key is missing or expired
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Take atomically gets and deletes key
+	Take(ctx context.Context, key string) ([]byte, error)
+
+	Delete(ctx context.Context, key string) error
+
+	// Keys returns the unexpired keys starting with prefix, in no particular order
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	Close() error
+}
+
+// New opens the backend selected by cfg.Backend.
+func New(ctx context.Context, cfg config.StoreConfig, secretProvider secrets.SecretProvider) (Backend, error) {
+	switch cfg.Backend {
+	case "", config.StoreBackendMemory:
+		return NewMemoryBackend(), nil
+	case config.StoreBackendBolt:
+		return NewBoltBackend(cfg.Path)
+	case config.StoreBackendRedis:
+		password := ""
+		if cfg.RedisPasswordName != "" {
+			var err error
+			password, err = secretProvider.GetSecret(ctx, cfg.RedisPasswordName)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewRedisBackend(ctx, cfg.RedisURL, password)
+	default:
+		return nil, fmt.Errorf("store: unknown backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// StateTTL bounds how long an authorization request waits for its callback.
+const StateTTL = 5 * time.Minute
+
+// State is an in-flight authorization request.
+type State struct {
+	// PKCE code verifier bound to the state
+	Verifier  string    `json:"verifier"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// application parameters of this onboarding given with the login request,
+	// empty to use the configured ones
+	Application map[string]string `json:"application,omitempty"`
+}
+
+type StateStore interface {
+	SaveState(ctx context.Context, state string, data *State, ttl time.Duration) error
+
+	// TakeState returns and removes the state, so that it can be used only once
+	TakeState(ctx context.Context, state string) (*State, error)
+}
+
+// Token is the part of an acquired token ucs reads back through /test/token.
+type Token struct {
+	AccessToken   string    `json:"access_token"`
+	ExpiresOn     time.Time `json:"expires_on"`
+	Username      string    `json:"username"`
+	HomeAccountID string    `json:"home_account_id"`
+	TenantID      string    `json:"tenant_id"`
+}
+
+type TokenStore interface {
+	// SaveToken stores the token until its ExpiresOn
+	SaveToken(ctx context.Context, key string, token *Token) error
+	GetToken(ctx context.Context, key string) (*Token, error)
+	DeleteToken(ctx context.Context, key string) error
+}
+
+func NewStateStore(backend Backend) StateStore {
+	return &stateStore{backend: backend}
+}
+
+func NewTokenStore(backend Backend) TokenStore {
+	return &tokenStore{backend: backend}
+}
+
+type stateStore struct {
+	backend Backend
+}
+
+func (s *stateStore) SaveState(ctx context.Context, state string, data *State, ttl time.Duration) error {
+	return setJSON(ctx, s.backend, "state:"+state, data, ttl)
+}
+
+func (s *stateStore) TakeState(ctx context.Context, state string) (*State, error) {
+	value, err := s.backend.Take(ctx, "state:"+state)
+	if err != nil {
+		return nil, err
+	}
+	data := &State{}
+	return data, json.Unmarshal(value, data)
+}
+
+type tokenStore struct {
+	backend Backend
+}
+
+func (s *tokenStore) SaveToken(ctx context.Context, key string, token *Token) error {
+	ttl := time.Until(token.ExpiresOn)
+	if ttl <= 0 {
+		return nil
+	}
+	return setJSON(ctx, s.backend, "token:"+key, token, ttl)
+}
+
+func (s *tokenStore) GetToken(ctx context.Context, key string) (*Token, error) {
+	token := &Token{}
+	if err := getJSON(ctx, s.backend, "token:"+key, token); err != nil {
+		return nil, err
+	}
+	if time.Now().After(token.ExpiresOn) {
+		return nil, ErrNotFound
+	}
+	return token, nil
+}
+
+func (s *tokenStore) DeleteToken(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, "token:"+key)
+}
+
+func setJSON(ctx context.Context, backend Backend, key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return backend.Set(ctx, key, value, ttl)
+}
+
+func getJSON(ctx context.Context, backend Backend, key string, v interface{}) error {
+	value, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"idp-test-go/secrets"
+	"time"
+)
+
+// tokenVault is a TokenStore that keeps tokens encrypted at rest with the
+// keyring's active key, and refuses to return tokens past their ExpiresOn.
+type tokenVault struct {
+	backend Backend
+	keyring *Keyring
+}
+
+type sealedToken struct {
+	KeyID     string    `json:"kid"`
+	ExpiresOn time.Time `json:"expires_on"`
+	Box       string    `json:"box"`
+}
+
+func NewTokenVault(backend Backend, keyring *Keyring) TokenStore {
+	return &tokenVault{backend: backend, keyring: keyring}
+}
+
+func (v *tokenVault) SaveToken(ctx context.Context, key string, token *Token) error {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return seal(ctx, v.backend, v.keyring, "vault:"+key, plaintext, token.ExpiresOn)
+}
+
+func (v *tokenVault) GetToken(ctx context.Context, key string) (*Token, error) {
+	plaintext, err := open(ctx, v.backend, v.keyring, "vault:"+key)
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	return token, json.Unmarshal(plaintext, token)
+}
+
+func (v *tokenVault) DeleteToken(ctx context.Context, key string) error {
+	return v.backend.Delete(ctx, "vault:"+key)
+}
+
+// CacheStore keeps opaque secrets, such as the MSAL cache holding the refresh
+// tokens or the scim token of an unfinished onboarding.
+type CacheStore interface {
+	SaveCache(ctx context.Context, key string, data []byte) error
+
+	// LoadCache returns ErrNotFound if nothing was saved under key
+	LoadCache(ctx context.Context, key string) ([]byte, error)
+
+	DeleteCache(ctx context.Context, key string) error
+}
+
+// cacheVault is a CacheStore sealing the cache like tokenVault seals tokens.
+// The cache is resealed on every save and kept for the keyring's retention.
+type cacheVault struct {
+	backend Backend
+	keyring *Keyring
+}
+
+func NewCacheVault(backend Backend, keyring *Keyring) CacheStore {
+	return &cacheVault{backend: backend, keyring: keyring}
+}
+
+func (v *cacheVault) SaveCache(ctx context.Context, key string, data []byte) error {
+	return seal(ctx, v.backend, v.keyring, "vault:cache:"+key, data, time.Now().Add(v.keyring.Retention()))
+}
+
+func (v *cacheVault) LoadCache(ctx context.Context, key string) ([]byte, error) {
+	return open(ctx, v.backend, v.keyring, "vault:cache:"+key)
+}
+
+func (v *cacheVault) DeleteCache(ctx context.Context, key string) error {
+	return v.backend.Delete(ctx, "vault:cache:"+key)
+}
+
+// seal stores plaintext under the keyring's active key until expiresOn, capped
+// at the keyring's retention so that the key outlives every entry it sealed
+func seal(ctx context.Context, backend Backend, keyring *Keyring, key string, plaintext []byte, expiresOn time.Time) error {
+	if limit := time.Now().Add(keyring.Retention()); keyring.Retention() > 0 && expiresOn.After(limit) {
+		expiresOn = limit
+	}
+	ttl := time.Until(expiresOn)
+	if ttl <= 0 {
+		return nil
+	}
+	keyID, sealKey, err := keyring.active()
+	if err != nil {
+		return err
+	}
+	box, err := secrets.Seal(sealKey, plaintext)
+	if err != nil {
+		return err
+	}
+	return setJSON(ctx, backend, key, &sealedToken{
+		KeyID:     keyID,
+		ExpiresOn: expiresOn,
+		Box:       string(box),
+	}, ttl)
+}
+
+func open(ctx context.Context, backend Backend, keyring *Keyring, key string) ([]byte, error) {
+	sealed := &sealedToken{}
+	if err := getJSON(ctx, backend, key, sealed); err != nil {
+		return nil, err
+	}
+	if time.Now().After(sealed.ExpiresOn) {
+		_ = backend.Delete(ctx, key)
+		return nil, ErrNotFound
+	}
+	openKey, err := keyring.key(sealed.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.Open(openKey, []byte(sealed.Box))
+}